@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The admin API manages backends at runtime. Backend addresses appear in
+// paths URL-escaped, e.g. /backends/http%3A%2F%2F10.0.0.1%3A8080.
+//
+//	GET    /backends                   list backends with status, latency and in-flight requests
+//	POST   /backends                   add a backend: {"address": "...", "weight": 1}
+//	GET    /backends/{address}         show one backend
+//	PATCH  /backends/{address}         change its weight: {"weight": 3}
+//	DELETE /backends/{address}         remove it
+//	PUT    /backends/{address}/status  force it {"status": "up"}, "down" or "drain", or back to "auto"
+//
+// An added backend is http_down until its first health check passes. A
+// draining backend gets no new requests. Deploy scripts can poll
+// GET /backends/{address} until "drained" is true, meaning its in-flight
+// count has reached zero, before stopping it.
+//
+// Changes are not written back to the config file.
+
+// validateAdminAddress refuses to expose an unauthenticated admin API beyond
+// the local machine.
+func validateAdminAddress(address, token string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return errors.New("AdminAddress is invalid: " + err.Error())
+	}
+	if token != "" {
+		return nil
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return errors.New("AdminAddress must be a loopback address unless AdminToken is set")
+	}
+	return nil
+}
+
+// backendView is how the admin API shows a backend.
+type backendView struct {
+	Address   string    `json:"address"`
+	Weight    int       `json:"weight"`
+	Status    string    `json:"status"`
+	LatencyMs float64   `json:"latency_ms"` // -1 until measured
+	InFlight  int64     `json:"in_flight"`
+	Forced    string    `json:"forced,omitempty"`
+	Drained   bool      `json:"drained"` // draining with nothing left in flight
+	Successes int       `json:"consecutive_successes"`
+	Failures  int       `json:"consecutive_failures"`
+	LastCheck time.Time `json:"last_check"`
+}
+
+func (l *LoadBalancer) viewBackend(b *backend) backendView {
+	status, _ := l.HostStatus.Load(b.address)
+	statusString, _ := status.(string)
+	latency := l.latency(b.address)
+	latencyMs := float64(-1)
+	if latency >= 0 {
+		latencyMs = float64(latency) / float64(time.Millisecond)
+	}
+	health := b.health.snapshot()
+	inFlight := b.inFlight.Load()
+	return backendView{
+		Address:   b.address,
+		Weight:    b.weight,
+		Status:    statusString,
+		LatencyMs: latencyMs,
+		InFlight:  inFlight,
+		Forced:    health.Forced,
+		Drained:   statusString == HTTP_STATUS_DRAINING && inFlight == 0,
+		Successes: health.Successes,
+		Failures:  health.Failures,
+		LastCheck: health.LastCheck,
+	}
+}
+
+// newAdminHandler returns the admin API, requiring AdminToken as a bearer
+// token if one is configured.
+func (l *LoadBalancer) newAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /backends", func(w http.ResponseWriter, r *http.Request) {
+		views := []backendView{}
+		for _, b := range l.backends() {
+			views = append(views, l.viewBackend(b))
+		}
+		writeAdminJSON(w, http.StatusOK, views)
+	})
+	mux.HandleFunc("POST /backends", func(w http.ResponseWriter, r *http.Request) {
+		var b struct {
+			Address string `json:"address"`
+			Weight  int    `json:"weight"`
+		}
+		if !decodeAdminJSON(w, r, &b) {
+			return
+		}
+		if err := l.AddBackend(Backend{Address: b.Address, Weight: b.Weight}); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		log.Printf("Admin API added backend %s", b.Address)
+		l.writeBackend(w, http.StatusCreated, b.Address)
+	})
+	mux.HandleFunc("GET /backends/{address}", func(w http.ResponseWriter, r *http.Request) {
+		l.writeBackend(w, http.StatusOK, r.PathValue("address"))
+	})
+	mux.HandleFunc("PATCH /backends/{address}", func(w http.ResponseWriter, r *http.Request) {
+		address := r.PathValue("address")
+		var change struct {
+			Weight *int `json:"weight"`
+		}
+		if !decodeAdminJSON(w, r, &change) {
+			return
+		}
+		if change.Weight == nil {
+			writeAdminJSON(w, http.StatusBadRequest, map[string]string{"error": "weight is required"})
+			return
+		}
+		if err := l.SetWeight(address, *change.Weight); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		log.Printf("Admin API set weight of backend %s to %d", address, *change.Weight)
+		l.writeBackend(w, http.StatusOK, address)
+	})
+	mux.HandleFunc("DELETE /backends/{address}", func(w http.ResponseWriter, r *http.Request) {
+		address := r.PathValue("address")
+		if err := l.RemoveBackend(address); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		log.Printf("Admin API removed backend %s", address)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("PUT /backends/{address}/status", func(w http.ResponseWriter, r *http.Request) {
+		address := r.PathValue("address")
+		var change struct {
+			Status string `json:"status"`
+		}
+		if !decodeAdminJSON(w, r, &change) {
+			return
+		}
+		forced, ok := map[string]string{"up": HTTP_STATUS_HEALTHY, "down": HTTP_STATUS_DOWN, "drain": HTTP_STATUS_DRAINING, "auto": ""}[change.Status]
+		if !ok {
+			writeAdminJSON(w, http.StatusBadRequest, map[string]string{"error": `status must be "up", "down", "drain" or "auto"`})
+			return
+		}
+		if err := l.ForceStatus(address, forced); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		log.Printf("Admin API forced backend %s %s", address, change.Status)
+		l.writeBackend(w, http.StatusOK, address)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := l.Config().AdminToken
+		if token == "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAdminJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid or missing admin token"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// ServeAdmin runs the admin API on AdminAddress until Shutdown.
+func (l *LoadBalancer) ServeAdmin() error {
+	address := l.Config().AdminAddress
+	log.Printf("Starting admin API on %s", address)
+	s := &http.Server{
+		Addr:    address,
+		Handler: l.newAdminHandler(),
+	}
+	if !l.startAdmin(s) {
+		return nil
+	}
+	if err := s.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (l *LoadBalancer) writeBackend(w http.ResponseWriter, status int, address string) {
+	b, ok := l.pool.Load().byAddress[address]
+	if !ok {
+		writeAdminError(w, errUnknownBackend)
+		return
+	}
+	writeAdminJSON(w, status, l.viewBackend(b))
+}
+
+func decodeAdminJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeAdminJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body: " + err.Error()})
+		return false
+	}
+	return true
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, errUnknownBackend):
+		status = http.StatusNotFound
+	case errors.Is(err, errBackendExists):
+		status = http.StatusConflict
+	}
+	writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminAPI(t *testing.T) {
+	a, b := "http://a.example", "http://b.example"
+	start := func(t *testing.T, config *Config) (*LoadBalancer, *httptest.Server) {
+		t.Helper()
+		lb := newTestLoadBalancer(t, config)
+		admin := httptest.NewServer(lb.newAdminHandler())
+		t.Cleanup(admin.Close)
+		return lb, admin
+	}
+	call := func(t *testing.T, admin *httptest.Server, method, path, body string) (int, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(method, admin.URL+path, strings.NewReader(body))
+		res, err := admin.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Failed to call admin API: %v", err)
+		}
+		defer res.Body.Close()
+		var out json.RawMessage
+		json.NewDecoder(res.Body).Decode(&out)
+		return res.StatusCode, out
+	}
+	picks := func(lb *LoadBalancer, n int) map[string]int {
+		counts := map[string]int{}
+		for i := 0; i < n; i++ {
+			if u := lb.getNextURL(); u != nil {
+				counts[u.String()]++
+			}
+		}
+		return counts
+	}
+
+	t.Run("TestListBackends", func(t *testing.T) {
+		lb, admin := start(t, &Config{InitialAddresses: []string{a, b}})
+		lb.HostLatency.Store(a, 2*time.Millisecond)
+		lb.acquire(a)
+		status, body := call(t, admin, http.MethodGet, "/backends", "")
+		var views []backendView
+		if err := json.Unmarshal(body, &views); err != nil || status != http.StatusOK {
+			t.Fatalf("unexpected response %d %s", status, body)
+		}
+		if len(views) != 2 || views[0].Address != a || views[0].Status != HTTP_STATUS_HEALTHY || views[0].LatencyMs != 2 || views[0].InFlight != 1 {
+			t.Errorf("unexpected backends: %+v", views)
+		}
+		if views[1].LatencyMs != -1 {
+			t.Errorf("expected unmeasured latency -1, got %v", views[1].LatencyMs)
+		}
+	})
+
+	t.Run("TestAddedBackendWaitsForCheck", func(t *testing.T) {
+		lb, admin := start(t, &Config{InitialAddresses: []string{a}, Protocol: "http"})
+		if status, body := call(t, admin, http.MethodPost, "/backends", `{"address":"`+b+`"}`); status != http.StatusCreated {
+			t.Fatalf("expected 201, got %d %s", status, body)
+		}
+		if got := picks(lb, 4)[b]; got != 0 {
+			t.Errorf("unchecked backend picked %d times", got)
+		}
+		lb.recordCheck(b, HTTP_STATUS_HEALTHY, 0, "health check passed")
+		if got := picks(lb, 4)[b]; got != 2 {
+			t.Errorf("expected checked backend to take 2 of 4 picks, got %d", got)
+		}
+	})
+
+	t.Run("TestAddAndRemove", func(t *testing.T) {
+		existing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer existing.Close()
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer backend.Close()
+		lb, admin := start(t, &Config{InitialAddresses: []string{existing.URL}, Protocol: "http", HealthCheckInterval: 1000, HealthCheckDownInterval: 20, HealthCheckTimeout: 500, HealthCheckUnhealthyThreshold: 1000})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		lb.StartHealthChecks(ctx)
+
+		if status, body := call(t, admin, http.MethodPost, "/backends", `{"address":"`+backend.URL+`","weight":2}`); status != http.StatusCreated {
+			t.Fatalf("expected 201, got %d %s", status, body)
+		}
+		if status, _ := call(t, admin, http.MethodPost, "/backends", `{"address":"`+backend.URL+`"}`); status != http.StatusConflict {
+			t.Errorf("expected duplicate add to conflict, got %d", status)
+		}
+		for _, address := range []string{"", "backend:8080", "ftp://backend:8080", "http://"} {
+			if status, _ := call(t, admin, http.MethodPost, "/backends", `{"address":"`+address+`"}`); status != http.StatusBadRequest {
+				t.Errorf("expected address %q to be rejected, got %d", address, status)
+			}
+		}
+		for i := 0; i < 100 && picks(lb, 3)[backend.URL] == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := picks(lb, 3)[backend.URL]; got != 2 {
+			t.Fatalf("expected added backend to take 2 of 3 picks once healthy, got %d", got)
+		}
+
+		path := "/backends/" + url.PathEscape(backend.URL)
+		if status, _ := call(t, admin, http.MethodDelete, path, ""); status != http.StatusNoContent {
+			t.Fatalf("expected 204, got %d", status)
+		}
+		if got := picks(lb, 10)[backend.URL]; got != 0 {
+			t.Errorf("removed backend still picked %d times", got)
+		}
+		if status, _ := call(t, admin, http.MethodGet, path, ""); status != http.StatusNotFound {
+			t.Errorf("expected removed backend to be gone, got %d", status)
+		}
+		if _, ok := lb.HostStatus.Load(backend.URL); ok {
+			t.Errorf("removed backend left in HostStatus")
+		}
+	})
+
+	t.Run("TestChangeWeight", func(t *testing.T) {
+		lb, admin := start(t, &Config{InitialAddresses: []string{a, b}})
+		status, body := call(t, admin, http.MethodPatch, "/backends/"+url.PathEscape(a), `{"weight":3}`)
+		if status != http.StatusOK || !strings.Contains(string(body), `"weight":3`) {
+			t.Fatalf("unexpected response %d %s", status, body)
+		}
+		if counts := picks(lb, 8); counts[a] != 6 || counts[b] != 2 {
+			t.Errorf("expected 3:1 split, got %v", counts)
+		}
+		for _, weight := range []string{"-1", "1001"} {
+			if status, _ := call(t, admin, http.MethodPatch, "/backends/"+url.PathEscape(a), `{"weight":`+weight+`}`); status != http.StatusBadRequest {
+				t.Errorf("expected weight %s to be rejected, got %d", weight, status)
+			}
+		}
+		if status, _ := call(t, admin, http.MethodPatch, "/backends/"+url.PathEscape("http://c.example"), `{"weight":2}`); status != http.StatusNotFound {
+			t.Errorf("expected unknown backend to be 404, got %d", status)
+		}
+	})
+
+	t.Run("TestForceStatus", func(t *testing.T) {
+		lb, admin := start(t, &Config{InitialAddresses: []string{a, b}})
+		path := "/backends/" + url.PathEscape(a) + "/status"
+		if status, body := call(t, admin, http.MethodPut, path, `{"status":"down"}`); status != http.StatusOK {
+			t.Fatalf("unexpected response %d %s", status, body)
+		}
+		if got := picks(lb, 4)[a]; got != 0 {
+			t.Errorf("forced down backend picked %d times", got)
+		}
+		lb.recordCheck(a, HTTP_STATUS_HEALTHY, 0, "")
+		if status, _ := lb.HostStatus.Load(a); status != HTTP_STATUS_DOWN {
+			t.Errorf("health check overrode forced status: %v", status)
+		}
+		call(t, admin, http.MethodPut, path, `{"status":"auto"}`)
+		if status, _ := lb.HostStatus.Load(a); status != HTTP_STATUS_HEALTHY {
+			t.Errorf("expected host back to its checked status, got %v", status)
+		}
+		if status, _ := call(t, admin, http.MethodPut, path, `{"status":"maybe"}`); status != http.StatusBadRequest {
+			t.Errorf("expected unknown status to be rejected, got %d", status)
+		}
+	})
+
+	t.Run("TestDrain", func(t *testing.T) {
+		lb, admin := start(t, &Config{InitialAddresses: []string{a, b}})
+		inFlight := lb.acquire(a)
+		path := "/backends/" + url.PathEscape(a)
+		var view backendView
+		_, body := call(t, admin, http.MethodPut, path+"/status", `{"status":"drain"}`)
+		json.Unmarshal(body, &view)
+		if view.Status != HTTP_STATUS_DRAINING || view.InFlight != 1 || view.Drained {
+			t.Errorf("expected draining with one request left, got %+v", view)
+		}
+		if got := picks(lb, 4)[a]; got != 0 {
+			t.Errorf("draining backend picked %d times", got)
+		}
+		lb.recordCheck(a, HTTP_STATUS_HEALTHY, 0, "")
+		lb.release(inFlight)
+		_, body = call(t, admin, http.MethodGet, path, "")
+		json.Unmarshal(body, &view)
+		if view.Status != HTTP_STATUS_DRAINING || !view.Drained {
+			t.Errorf("expected drained backend, got %+v", view)
+		}
+	})
+
+	t.Run("TestToken", func(t *testing.T) {
+		_, admin := start(t, &Config{InitialAddresses: []string{a}, AdminToken: "s3cret"})
+		if status, _ := call(t, admin, http.MethodGet, "/backends", ""); status != http.StatusUnauthorized {
+			t.Errorf("expected 401 without token, got %d", status)
+		}
+		req, _ := http.NewRequest(http.MethodGet, admin.URL+"/backends", nil)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		res, err := admin.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Failed to call admin API: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("expected 200 with token, got %d", res.StatusCode)
+		}
+	})
+
+	t.Run("TestAdminAddress", func(t *testing.T) {
+		cases := []struct {
+			address, token string
+			valid          bool
+		}{
+			{"127.0.0.1:9090", "", true},
+			{"localhost:9090", "", true},
+			{"[::1]:9090", "", true},
+			{":9090", "", false},
+			{"10.0.0.5:9090", "", false},
+			{":9090", "s3cret", true},
+			{"9090", "s3cret", false},
+		}
+		for _, c := range cases {
+			if err := validateAdminAddress(c.address, c.token); (err == nil) != c.valid {
+				t.Errorf("%q with token %q: expected valid=%v, got %v", c.address, c.token, c.valid, err)
+			}
+		}
+	})
+}
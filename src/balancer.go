@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ALGORITHM_ROUND_ROBIN     = "round_robin"
+	ALGORITHM_LEAST_LATENCY   = "least_latency"
+	ALGORITHM_LEAST_CONN      = "least_conn"
+	ALGORITHM_CONSISTENT_HASH = "consistent_hash"
+	ALGORITHM_P2C             = "p2c"
+)
+
+// highLatencyPenalty multiplies the score of HTTP_STATUS_HIGH_LATENCY hosts
+// in least_latency mode so they are avoided but still usable.
+const highLatencyPenalty = 4
+
+// Balancer decides which backend receives each request. LoadBalancer calls
+// Pick with a snapshot of every configured host, and Done once the request
+// (or TCP connection) it was picked for has finished.
+type Balancer interface {
+	// Pick returns the Address of the chosen host, or "" if none of hosts is
+	// usable. For TCP connections in "rpc" mode r only carries RemoteAddr.
+	// hosts is reused by later picks, so it is only valid until Pick
+	// returns; copy anything kept beyond that.
+	Pick(r *http.Request, hosts []HostState) string
+	// Done reports that a request sent to host completed after elapsed, with
+	// err set if the upstream failed.
+	Done(host string, elapsed time.Duration, err error)
+}
+
+// HostState is a point-in-time view of one backend handed to a Balancer.
+type HostState struct {
+	Address  string
+	Weight   int
+	Status   string
+	Latency  time.Duration // -1 until the first measurement
+	InFlight int64
+
+	rrWeight *atomic.Int64 // smooth round-robin counter kept with the backend
+}
+
+// Available reports whether new requests may be sent to the host.
+func (h HostState) Available() bool {
+	return h.Status != "" && h.Status != HTTP_STATUS_DOWN && h.Status != HTTP_STATUS_EJECTED && h.Status != HTTP_STATUS_DRAINING
+}
+
+// BalancerFactory builds a Balancer for a config. It is called once per
+// LoadBalancer and again on every Reload, and may reject settings the
+// strategy cannot use.
+type BalancerFactory func(config *Config) (Balancer, error)
+
+var balancers = map[string]BalancerFactory{
+	ALGORITHM_ROUND_ROBIN: func(*Config) (Balancer, error) {
+		return newRoundRobinBalancer(), nil
+	},
+	ALGORITHM_LEAST_LATENCY: func(*Config) (Balancer, error) {
+		return &leastLatencyBalancer{}, nil
+	},
+	ALGORITHM_LEAST_CONN: func(*Config) (Balancer, error) {
+		return &leastConnBalancer{rr: newRoundRobinBalancer()}, nil
+	},
+	ALGORITHM_CONSISTENT_HASH: newConsistentHashBalancer,
+	ALGORITHM_P2C: func(*Config) (Balancer, error) {
+		return &p2cBalancer{}, nil
+	},
+}
+
+// RegisterBalancer makes a custom strategy selectable through
+// Config.Algorithm. It is not safe for concurrent use and is meant to be
+// called from init functions.
+func RegisterBalancer(name string, factory BalancerFactory) {
+	balancers[name] = factory
+}
+
+func newBalancer(config *Config) (Balancer, error) {
+	name := config.Algorithm
+	if name == "" {
+		name = ALGORITHM_ROUND_ROBIN
+	}
+	factory, ok := balancers[name]
+	if !ok {
+		return nil, errors.New("Unsupported algorithm: " + name)
+	}
+	return factory(config)
+}
+
+// roundRobinBalancer is nginx-style smooth weighted round-robin: every
+// candidate gains its weight, the highest one wins and pays back the total,
+// which interleaves picks instead of sending bursts. The running weights are
+// atomic counters stored with each backend in the pool snapshot, so picks
+// take no lock and a removed backend takes its counter with it. When all
+// candidates have the same weight this reduces to plain rotation, served
+// from a single atomic counter.
+type roundRobinBalancer struct {
+	next atomic.Uint64
+}
+
+func newRoundRobinBalancer() *roundRobinBalancer {
+	return &roundRobinBalancer{}
+}
+
+func (b *roundRobinBalancer) Pick(_ *http.Request, hosts []HostState) string {
+	return b.pick(hosts, HostState.Available)
+}
+
+func (b *roundRobinBalancer) Done(string, time.Duration, error) {}
+
+// pick runs one round over the hosts accepted by include.
+func (b *roundRobinBalancer) pick(hosts []HostState, include func(HostState) bool) string {
+	count, weight, uniform := 0, 0, true
+	for _, h := range hosts {
+		if !include(h) {
+			continue
+		}
+		if count == 0 {
+			weight = h.Weight
+		} else if h.Weight != weight {
+			uniform = false
+		}
+		count++
+	}
+	if count == 0 {
+		return ""
+	}
+	if !uniform {
+		return b.smooth(hosts, include)
+	}
+	n := int(b.next.Add(1) % uint64(count))
+	for _, h := range hosts {
+		if !include(h) {
+			continue
+		}
+		if n == 0 {
+			return h.Address
+		}
+		n--
+	}
+	return ""
+}
+
+// smooth runs one round of weighted round-robin. Concurrent picks may both
+// see the same host ahead, but each adds and pays back the same total, so
+// the counters stay bounded and the split converges to the weights.
+func (b *roundRobinBalancer) smooth(hosts []HostState, include func(HostState) bool) string {
+	best := -1
+	var bestWeight, total int64
+	for i, h := range hosts {
+		if !include(h) || h.rrWeight == nil {
+			continue
+		}
+		weight := h.rrWeight.Add(int64(h.Weight))
+		total += int64(h.Weight)
+		if best < 0 || weight > bestWeight {
+			best, bestWeight = i, weight
+		}
+	}
+	if best < 0 {
+		return ""
+	}
+	hosts[best].rrWeight.Add(-total)
+	return hosts[best].Address
+}
+
+// leastConnBalancer picks the available host with the fewest in-flight
+// requests per unit of weight. Ties are broken by weighted round-robin among
+// the tied hosts, so heavier hosts win ties proportionally more often.
+type leastConnBalancer struct {
+	rr *roundRobinBalancer
+}
+
+func (b *leastConnBalancer) Pick(_ *http.Request, hosts []HostState) string {
+	bestScore := -1.0
+	for _, h := range hosts {
+		if !h.Available() {
+			continue
+		}
+		if score := connScore(h); bestScore < 0 || score < bestScore {
+			bestScore = score
+		}
+	}
+	return b.rr.pick(hosts, func(h HostState) bool {
+		return h.Available() && connScore(h) == bestScore
+	})
+}
+
+func (b *leastConnBalancer) Done(string, time.Duration, error) {}
+
+func connScore(h HostState) float64 {
+	return float64(h.InFlight) / float64(h.Weight)
+}
+
+// leastLatencyBalancer picks the available host with the lowest latency per
+// unit of weight. Hosts without a measurement yet score zero so they get
+// traffic and a first sample; ties go to whichever comes first after a
+// rotating offset.
+type leastLatencyBalancer struct {
+	offset atomic.Uint64
+}
+
+func (b *leastLatencyBalancer) Pick(_ *http.Request, hosts []HostState) string {
+	if len(hosts) == 0 {
+		return ""
+	}
+	offset := int(b.offset.Add(1) % uint64(len(hosts)))
+	best := ""
+	bestScore := 0.0
+	for i := range hosts {
+		h := hosts[(offset+i)%len(hosts)]
+		if !h.Available() {
+			continue
+		}
+		score := float64(h.Latency) / float64(h.Weight)
+		if score < 0 {
+			score = 0
+		}
+		if h.Status == HTTP_STATUS_HIGH_LATENCY {
+			score = (score + 1) * highLatencyPenalty
+		}
+		if best == "" || score < bestScore {
+			best, bestScore = h.Address, score
+		}
+	}
+	return best
+}
+
+func (b *leastLatencyBalancer) Done(string, time.Duration, error) {}
+
+// p2cBalancer is power-of-two-choices: it samples two distinct available
+// hosts at random, weighted by Weight, and keeps the one with fewer in-flight requests
+// per unit of weight, falling back to lower latency on a tie. It needs no
+// shared state, so independent LB instances do not move in lockstep.
+type p2cBalancer struct{}
+
+func (b *p2cBalancer) Pick(_ *http.Request, hosts []HostState) string {
+	total := 0
+	for _, h := range hosts {
+		if h.Available() {
+			total += h.Weight
+		}
+	}
+	if total == 0 {
+		return ""
+	}
+	first := sampleWeighted(hosts, rand.Intn(total), -1)
+	rest := total - hosts[first].Weight
+	if rest == 0 {
+		return hosts[first].Address
+	}
+	second := sampleWeighted(hosts, rand.Intn(rest), first)
+	if p2cLess(hosts[second], hosts[first]) {
+		return hosts[second].Address
+	}
+	return hosts[first].Address
+}
+
+func (b *p2cBalancer) Done(string, time.Duration, error) {}
+
+// sampleWeighted returns the index of the available host covering point in
+// the cumulative weights, leaving out the host at index skip.
+func sampleWeighted(hosts []HostState, point, skip int) int {
+	for i, h := range hosts {
+		if !h.Available() || i == skip {
+			continue
+		}
+		if point < h.Weight {
+			return i
+		}
+		point -= h.Weight
+	}
+	return -1
+}
+
+func p2cLess(a, b HostState) bool {
+	if scoreA, scoreB := connScore(a), connScore(b); scoreA != scoreB {
+		return scoreA < scoreB
+	}
+	return a.Latency < b.Latency
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+)
+
+// Settings can come from four layers, each overriding the one before:
+// defaults, the config file, GLB_* environment variables and command-line
+// flags. Every field of Config, including those of nested sections such as
+// Retry.MaxAttempts, has an environment variable and a flag named after it:
+//
+//	Port                 GLB_PORT                  -port
+//	InitialAddresses     GLB_INITIAL_ADDRESSES     -initial-addresses
+//	Retry.MaxAttempts    GLB_RETRY_MAX_ATTEMPTS    -retry-max-attempts
+//
+// Lists of strings or numbers are comma-separated, e.g.
+// GLB_INITIAL_ADDRESSES=http://a:8080,http://b:8080. Other lists, maps and
+// any list whose items contain commas are given as JSON.
+//
+// A zero value in a layer leaves the value from the layers below, as zero
+// means "use the default" throughout Config. Empty environment variables are
+// ignored, and unknown GLB_* variables are logged so typos are noticed.
+
+const envPrefix = "GLB_"
+
+// defaultConfig is the bottom layer: values for settings that have no
+// usable zero value.
+func defaultConfig() Config {
+	return Config{
+		Port:                          8080,
+		Protocol:                      "http",
+		ShutdownTimeout:               defaultShutdownTimeout,
+		HealthCheckInterval:           defaultHealthCheckInterval,
+		HealthCheckTimeout:            defaultHealthCheckTimeout,
+		HealthCheckUnhealthyThreshold: defaultHealthCheckUnhealthyThreshold,
+		HealthCheckDownInterval:       defaultHealthCheckDownInterval,
+		HealthyThreshold:              1,
+		UnhealthyThreshold:            1,
+		HealthCheckConcurrency:        defaultHealthCheckConcurrency,
+	}
+}
+
+// configSetting is one leaf field of Config, such as Port or
+// Retry.MaxAttempts.
+type configSetting struct {
+	name     string // Go path, e.g. Retry.MaxAttempts
+	env      string // e.g. GLB_RETRY_MAX_ATTEMPTS
+	flagName string // e.g. retry-max-attempts
+	index    []int
+	typ      reflect.Type
+}
+
+var textUnmarshaler = reflect.TypeFor[encoding.TextUnmarshaler]()
+
+// configSettings lists every leaf of Config in declaration order.
+func configSettings() []configSetting {
+	var settings []configSetting
+	var walk func(t reflect.Type, index []int, names []string)
+	walk = func(t reflect.Type, index []int, names []string) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			fieldIndex := append(append([]int(nil), index...), i)
+			fieldNames := append(append([]string(nil), names...), field.Name)
+			if field.Type.Kind() == reflect.Struct && !reflect.PointerTo(field.Type).Implements(textUnmarshaler) {
+				walk(field.Type, fieldIndex, fieldNames)
+				continue
+			}
+			var words []string
+			for _, name := range fieldNames {
+				words = append(words, splitWords(name)...)
+			}
+			settings = append(settings, configSetting{
+				name:     strings.Join(fieldNames, "."),
+				env:      envPrefix + strings.ToUpper(strings.Join(words, "_")),
+				flagName: strings.ToLower(strings.Join(words, "-")),
+				index:    fieldIndex,
+				typ:      field.Type,
+			})
+		}
+	}
+	walk(reflect.TypeFor[Config](), nil, nil)
+	return settings
+}
+
+// splitWords splits a Go identifier into words, keeping acronyms together:
+// GRPCHealthCheck becomes GRPC, Health, Check.
+func splitWords(name string) []string {
+	runes := []rune(name)
+	var words []string
+	start := 0
+	for i := 1; i < len(runes); i++ {
+		lowerBefore := unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1])
+		acronymEnd := unicode.IsUpper(runes[i-1]) && i+1 < len(runes) && unicode.IsLower(runes[i+1])
+		if unicode.IsUpper(runes[i]) && (lowerBefore || acronymEnd) {
+			words = append(words, string(runes[start:i]))
+			start = i
+		}
+	}
+	return append(words, string(runes[start:]))
+}
+
+func (s configSetting) field(c *Config) reflect.Value {
+	return reflect.ValueOf(c).Elem().FieldByIndex(s.index)
+}
+
+// set parses text as the value of s in c.
+func (s configSetting) set(c *Config, text string) error {
+	v, err := parseSetting(s.typ, text)
+	if err != nil {
+		return err
+	}
+	s.field(c).Set(v)
+	return nil
+}
+
+func parseSetting(t reflect.Type, text string) (reflect.Value, error) {
+	v := reflect.New(t)
+	if u, ok := v.Interface().(encoding.TextUnmarshaler); ok {
+		return v.Elem(), u.UnmarshalText([]byte(text))
+	}
+	v = v.Elem()
+	switch t.Kind() {
+	case reflect.String:
+		v.SetString(text)
+		return v, nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return v, fmt.Errorf("invalid boolean %q", text)
+		}
+		v.SetBool(b)
+		return v, nil
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return v, fmt.Errorf("invalid integer %q", text)
+		}
+		v.SetInt(n)
+		return v, nil
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return v, fmt.Errorf("invalid number %q", text)
+		}
+		v.SetFloat(f)
+		return v, nil
+	case reflect.Slice:
+		elem := t.Elem().Kind()
+		if (elem == reflect.String || elem == reflect.Int) && !strings.HasPrefix(strings.TrimSpace(text), "[") {
+			for _, item := range strings.Split(text, ",") {
+				parsed, err := parseSetting(t.Elem(), strings.TrimSpace(item))
+				if err != nil {
+					return v, err
+				}
+				v = reflect.Append(v, parsed)
+			}
+			return v, nil
+		}
+	}
+	if err := json.Unmarshal([]byte(text), v.Addr().Interface()); err != nil {
+		return v, fmt.Errorf("invalid JSON %q: %s", text, strings.TrimPrefix(err.Error(), "json: "))
+	}
+	return v, nil
+}
+
+// ConfigLoader builds a Config from all four layers. It can be run again on
+// reload, which rereads the file while keeping the same environment and
+// flags.
+type ConfigLoader struct {
+	Path  string            // config file, empty to use only the other layers
+	Env   []string          // KEY=value pairs, normally os.environ()
+	Flags map[string]string // setting name, e.g. Retry.MaxAttempts -> value given on the command line
+}
+
+// Load returns the merged config and, for every setting, where its value
+// came from: "default", "file <path>", "env GLB_..." or "flag -...".
+func (c *ConfigLoader) Load() (Config, map[string]string, error) {
+	config := defaultConfig()
+	settings := configSettings()
+	sources := make(map[string]string, len(settings))
+	for _, s := range settings {
+		sources[s.name] = "default"
+	}
+
+	if c.Path != "" {
+		reader, err := NewConfigReader(c.Path)
+		if err != nil {
+			return Config{}, nil, err
+		}
+		file, err := reader.ReadConfig()
+		if err != nil {
+			return Config{}, nil, err
+		}
+		for _, s := range settings {
+			if value := s.field(&file); !value.IsZero() {
+				s.field(&config).Set(value)
+				sources[s.name] = "file " + c.Path
+			}
+		}
+	}
+
+	env := map[string]string{}
+	for _, kv := range c.Env {
+		if key, value, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(key, envPrefix) {
+			env[key] = value
+		}
+	}
+	for _, s := range settings {
+		value, ok := env[s.env]
+		delete(env, s.env)
+		if !ok || value == "" {
+			continue
+		}
+		if err := s.set(&config, value); err != nil {
+			return Config{}, nil, fmt.Errorf("%s: %w", s.env, err)
+		}
+		sources[s.name] = "env " + s.env
+	}
+	for _, key := range slices.Sorted(maps.Keys(env)) {
+		log.Printf("Ignoring unknown environment variable %s", key)
+	}
+
+	for _, s := range settings {
+		value, ok := c.Flags[s.name]
+		if !ok {
+			continue
+		}
+		if err := s.set(&config, value); err != nil {
+			return Config{}, nil, fmt.Errorf("-%s: %w", s.flagName, err)
+		}
+		sources[s.name] = "flag -" + s.flagName
+	}
+	return config, sources, nil
+}
+
+// registerConfigFlags adds a flag for every setting to flags. The values
+// given are collected in the returned map for ConfigLoader.Flags.
+func registerConfigFlags(flags *flag.FlagSet) map[string]string {
+	values := map[string]string{}
+	for _, s := range configSettings() {
+		flags.Func(s.flagName, "sets "+s.name+", overriding "+s.env+" and the config file", func(value string) error {
+			if _, err := parseSetting(s.typ, value); err != nil {
+				return err
+			}
+			values[s.name] = value
+			return nil
+		})
+	}
+	return values
+}
+
+// secretSettings are not shown by printConfig.
+var secretSettings = map[string]bool{"StickySecret": true, "AdminToken": true}
+
+// printConfig writes every setting of config with its value and source.
+func printConfig(w io.Writer, config *Config, sources map[string]string) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, s := range configSettings() {
+		value := s.field(config)
+		shown := "<redacted>"
+		if !secretSettings[s.name] || value.IsZero() {
+			encoded, err := json.Marshal(value.Interface())
+			if err != nil {
+				return err
+			}
+			shown = string(encoded)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", s.name, shown, sources[s.name])
+	}
+	return tw.Flush()
+}
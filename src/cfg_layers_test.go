@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLayeredConfig(t *testing.T) {
+	log.SetOutput(io.Discard)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte("Port: 9000\nHost: file.example\nInitialAddresses: [http://file.example]\nRetry:\n  MaxAttempts: 2\n"), 0644)
+
+	t.Run("TestPrecedence", func(t *testing.T) {
+		loader := &ConfigLoader{
+			Path:  path,
+			Env:   []string{"GLB_HOST=env.example", "GLB_PORT=9100", "GLB_PROTOCOL=", "PATH=/bin"},
+			Flags: map[string]string{"Port": "9200"},
+		}
+		config, sources, err := loader.Load()
+		if err != nil {
+			t.Fatalf("Load() error = %v", err)
+		}
+		if config.Port != 9200 || config.Host != "env.example" || config.Retry.MaxAttempts != 2 || config.Protocol != "http" {
+			t.Errorf("unexpected merged config: %+v", config)
+		}
+		want := map[string]string{
+			"Port":              "flag -port",
+			"Host":              "env GLB_HOST",
+			"Retry.MaxAttempts": "file " + path,
+			"InitialAddresses":  "file " + path,
+			"Protocol":          "default",
+		}
+		for name, source := range want {
+			if sources[name] != source {
+				t.Errorf("%s: expected source %q, got %q", name, source, sources[name])
+			}
+		}
+	})
+
+	t.Run("TestEnvValues", func(t *testing.T) {
+		loader := &ConfigLoader{Env: []string{
+			"GLB_INITIAL_ADDRESSES=http://a.example, http://b.example",
+			"GLB_RETRY_RETRYABLE_STATUSES=502,504",
+			"GLB_RETRY_BUDGET_PERCENT=12.5",
+			"GLB_GRPC_HEALTH_CHECK_TLS=true",
+			`GLB_BACKENDS=[{"Address": "http://c.example", "Weight": 3}]`,
+			`GLB_ERROR_TEMPLATES={"503": "busy"}`,
+			`GLB_NOTIFICATIONS_EXEC_COMMAND=["sh", "-c", "echo a,b"]`,
+			"GLB_HEALTH_CHECK_TIMEOUT=750ms",
+			"GLB_HEALTH_CHECK_DOWN_INTERVAL=3000",
+		}}
+		config, _, err := loader.Load()
+		if err != nil {
+			t.Fatalf("Load() error = %v", err)
+		}
+		if !reflect.DeepEqual(config.InitialAddresses, []string{"http://a.example", "http://b.example"}) {
+			t.Errorf("unexpected InitialAddresses %q", config.InitialAddresses)
+		}
+		if !reflect.DeepEqual(config.Retry.RetryableStatuses, []int{502, 504}) || config.Retry.BudgetPercent != 12.5 || !config.GRPCHealthCheck.TLS {
+			t.Errorf("unexpected Retry or GRPCHealthCheck: %+v %+v", config.Retry, config.GRPCHealthCheck)
+		}
+		if !reflect.DeepEqual(config.Backends, []Backend{{Address: "http://c.example", Weight: 3}}) || config.ErrorTemplates[503] != "busy" {
+			t.Errorf("unexpected Backends or ErrorTemplates: %+v %+v", config.Backends, config.ErrorTemplates)
+		}
+		if !reflect.DeepEqual(config.Notifications.ExecCommand, []string{"sh", "-c", "echo a,b"}) {
+			t.Errorf("unexpected ExecCommand %q", config.Notifications.ExecCommand)
+		}
+		if config.HealthCheckTimeout != 750 || config.HealthCheckDownInterval != 3000 {
+			t.Errorf("unexpected HealthCheckTimeout %d or HealthCheckDownInterval %d", config.HealthCheckTimeout, config.HealthCheckDownInterval)
+		}
+	})
+
+	t.Run("TestInvalidValues", func(t *testing.T) {
+		for _, env := range []string{"GLB_PORT=eighty", "GLB_GRPC_HEALTH_CHECK_TLS=maybe", "GLB_RETRY_RETRYABLE_STATUSES=502,x", "GLB_BACKENDS=[{", "GLB_HEALTH_CHECK_INTERVAL=soon"} {
+			_, _, err := (&ConfigLoader{Env: []string{env}}).Load()
+			if name, _, _ := strings.Cut(env, "="); err == nil || !strings.Contains(err.Error(), name) {
+				t.Errorf("%s: expected error naming the variable, got %v", env, err)
+			}
+		}
+		if _, _, err := (&ConfigLoader{Path: filepath.Join(t.TempDir(), "missing.json")}).Load(); err == nil {
+			t.Errorf("expected error for missing config file")
+		}
+	})
+
+	t.Run("TestNames", func(t *testing.T) {
+		envs, flags := map[string]bool{}, map[string]bool{}
+		for _, s := range configSettings() {
+			if envs[s.env] || flags[s.flagName] {
+				t.Errorf("duplicate name for %s: %s / -%s", s.name, s.env, s.flagName)
+			}
+			envs[s.env], flags[s.flagName] = true, true
+		}
+		for _, name := range []string{"GLB_GRPC_HEALTH_CHECK_SERVER_NAME", "GLB_HEALTH_CHECK_JSON_ASSERTIONS", "GLB_NOTIFICATIONS_WEBHOOK_URL", "GLB_HEALTH_CHECK_UNHEALTHY_THRESHOLD"} {
+			if !envs[name] {
+				t.Errorf("expected setting %s", name)
+			}
+		}
+	})
+
+	t.Run("TestFlags", func(t *testing.T) {
+		flags := flag.NewFlagSet("glb", flag.ContinueOnError)
+		flags.SetOutput(io.Discard)
+		values := registerConfigFlags(flags)
+		if err := flags.Parse([]string{"-port", "9300", "-outlier-detection-consecutive-failures", "5"}); err != nil {
+			t.Fatalf("Parse() error = %v", err)
+		}
+		config, sources, err := (&ConfigLoader{Flags: values}).Load()
+		if err != nil {
+			t.Fatalf("Load() error = %v", err)
+		}
+		if config.Port != 9300 || config.OutlierDetection.ConsecutiveFailures != 5 || sources["OutlierDetection.ConsecutiveFailures"] != "flag -outlier-detection-consecutive-failures" {
+			t.Errorf("unexpected config %+v with sources %v", config, sources)
+		}
+		if err := flags.Parse([]string{"-port", "high"}); err == nil {
+			t.Errorf("expected invalid flag value to be rejected")
+		}
+	})
+
+	t.Run("TestPrintConfig", func(t *testing.T) {
+		config, sources, err := (&ConfigLoader{Path: path, Env: []string{"GLB_ADMIN_TOKEN=s3cret"}}).Load()
+		if err != nil {
+			t.Fatalf("Load() error = %v", err)
+		}
+		var out bytes.Buffer
+		if err := printConfig(&out, &config, sources); err != nil {
+			t.Fatalf("printConfig() error = %v", err)
+		}
+		if strings.Contains(out.String(), "s3cret") {
+			t.Errorf("printed config leaks AdminToken:\n%s", out.String())
+		}
+		lines := map[string]string{}
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			name, _, _ := strings.Cut(line, " ")
+			lines[name] = strings.Join(strings.Fields(line), " ")
+		}
+		for name, want := range map[string]string{
+			"Port":                "Port 9000 file " + path,
+			"AdminToken":          "AdminToken <redacted> env GLB_ADMIN_TOKEN",
+			"HealthCheckInterval": `HealthCheckInterval "10s" default`,
+		} {
+			if lines[name] != want {
+				t.Errorf("expected %q, got %q", want, lines[name])
+			}
+		}
+	})
+}
@@ -1,26 +1,137 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Defaults for the health check timings left at 0.
+const (
+	defaultHealthCheckInterval           Milliseconds = 10000
+	defaultHealthCheckTimeout            Milliseconds = 2000
+	defaultHealthCheckUnhealthyThreshold Milliseconds = 1000
+	defaultHealthCheckDownInterval       Milliseconds = 5000
 )
 
+// Milliseconds is a duration setting. Config files, environment variables
+// and flags may give it as a Go duration string such as "500ms" or "5s", or
+// as a plain number of milliseconds.
+type Milliseconds int
+
+func (m Milliseconds) Duration() time.Duration {
+	return time.Duration(m) * time.Millisecond
+}
+
+// or returns m, or def if m is 0.
+func (m Milliseconds) or(def Milliseconds) Milliseconds {
+	if m == 0 {
+		return def
+	}
+	return m
+}
+
+func (m Milliseconds) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.Duration().String())
+}
+
+func (m *Milliseconds) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var text string
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+		return m.UnmarshalText([]byte(text))
+	}
+	return m.UnmarshalText(data)
+}
+
+func (m *Milliseconds) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+	if n, err := strconv.Atoi(s); err == nil {
+		*m = Milliseconds(n)
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q, expected milliseconds or a Go duration such as \"500ms\" or \"5s\"", s)
+	}
+	if d%time.Millisecond != 0 {
+		return fmt.Errorf("duration %q is not a whole number of milliseconds", s)
+	}
+	*m = Milliseconds(d / time.Millisecond)
+	return nil
+}
+
 type ConfigReader interface {
 	ReadConfig() (Config, error)
 }
 
+// Backend is a single upstream with its relative share of traffic. A zero
+// Weight is treated as 1; at most maxWeight is allowed.
+type Backend struct {
+	Address string
+	Weight  int
+}
+
 type Config struct {
 	Host                          string
 	Port                          int
 	InitialAddresses              []string
+	Backends                      []Backend
 	Protocol                      string
+	Algorithm                     string         // round_robin (default), least_latency, least_conn, consistent_hash, p2c or a registered Balancer
+	HashKey                       string         // consistent_hash only: ip (default), path, header:<name> or cookie:<name>
+	StickyCookie                  string         // name of the session affinity cookie, empty disables sticky sessions
+	StickySecret                  string         // HMAC key for StickyCookie values, random per process if empty
+	DrainStickyGrace              Milliseconds   // how long sticky sessions may keep using a draining host, 0 moves them at once
+	UpstreamTimeout               Milliseconds   // how long to wait for response headers before answering 504, 0 waits forever
+	ShutdownTimeout               Milliseconds   // how long in-flight requests get to finish after SIGTERM or SIGINT, default 30s
+	ErrorFormat                   string         // text (default), json or html body for 502/503/504 responses
+	ErrorTemplates                map[int]string // optional per-status Go templates overriding the built-in body
+	Retry                         RetryPolicy
+	OutlierDetection              OutlierDetection
+	HealthCheck                   HTTPHealthCheck
+	GRPCHealthCheck               GRPCHealthCheck
+	Notifications                 Notifications
+	AdminAddress                  string // listen address of the admin API such as 127.0.0.1:9090, empty disables it
+	AdminToken                    string // bearer token for the admin API; without one AdminAddress must be loopback
+	HealthCheckType               string // http (default for the http protocol), tcp (default for rpc), grpc or a registered Checker
 	HealthCheckPath               string
-	HealthCheckInterval           int //ms
-	HealthCheckTimeout            int //ms
-	HealthCheckUnhealthyThreshold int //ms
-	HealthCheckDownInterval       int //ms
+	HealthCheckInterval           Milliseconds // between checks of a live host, default 10s
+	HealthCheckTimeout            Milliseconds // before a check fails, default 2s; must be below HealthCheckInterval
+	HealthCheckUnhealthyThreshold Milliseconds // latency above which a host is marked HIGH_LATENCY, default 1s; must be below HealthCheckTimeout
+	HealthCheckDownInterval       Milliseconds // between checks of a down host, default 5s
+	HealthyThreshold              int          // consecutive passing checks before a down host returns, default 1
+	UnhealthyThreshold            int          // consecutive failing checks before a live host goes down, default 1
+	HealthCheckConcurrency        int          // health checks running at once across all hosts, default 16
+}
+
+// NewConfigReader picks a ConfigReader by the extension of path: .json,
+// .yaml or .yml, or .toml.
+func NewConfigReader(path string) (ConfigReader, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return &JsonConfigReader{Path: path}, nil
+	case ".yaml", ".yml":
+		return &YamlConfigReader{Path: path}, nil
+	case ".toml":
+		return &TomlConfigReader{Path: path}, nil
+	default:
+		return nil, fmt.Errorf("Config file %s must end in .json, .yaml, .yml or .toml", path)
+	}
 }
 
 type JsonConfigReader struct {
@@ -28,48 +139,318 @@ type JsonConfigReader struct {
 }
 
 func (j *JsonConfigReader) ReadConfig() (Config, error) {
-	_, err := os.Stat(j.Path)
+	data, err := readConfigFile(j.Path, ".json")
 	if err != nil {
-		log.Printf("Config file not found: %s", j.Path)
 		return Config{}, err
 	}
-	if len(j.Path) < 5 && j.Path[len(j.Path)-5:] != ".json" {
-		log.Printf("Config file must be a JSON file")
+	config, err := decodeConfig(data)
+	if err != nil {
+		log.Printf("Error decoding config file: %s", j.Path)
 		return Config{}, err
 	}
-	file, err := os.Open(j.Path)
+	return config, nil
+}
+
+// YamlConfigReader reads the same fields as JsonConfigReader, written as
+// YAML.
+type YamlConfigReader struct {
+	Path string
+}
+
+func (y *YamlConfigReader) ReadConfig() (Config, error) {
+	data, err := readConfigFile(y.Path, ".yaml", ".yml")
 	if err != nil {
-		log.Printf("Error opening config file: %s", j.Path)
 		return Config{}, err
 	}
-	decoder := json.NewDecoder(file)
-	config := Config{}
-	err = decoder.Decode(&config)
+	var doc any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		log.Printf("Error decoding config file: %s", y.Path)
+		return Config{}, err
+	}
+	return reencodeConfig(y.Path, doc)
+}
+
+// TomlConfigReader reads the same fields as JsonConfigReader, written as
+// TOML.
+type TomlConfigReader struct {
+	Path string
+}
+
+func (t *TomlConfigReader) ReadConfig() (Config, error) {
+	data, err := readConfigFile(t.Path, ".toml")
 	if err != nil {
-		log.Printf("Error decoding config file: %s", j.Path)
 		return Config{}, err
 	}
+	doc := map[string]any{}
+	if err := toml.Unmarshal(data, &doc); err != nil {
+		log.Printf("Error decoding config file: %s", t.Path)
+		return Config{}, err
+	}
+	return reencodeConfig(t.Path, doc)
+}
+
+// readConfigFile returns the contents of path, which must end in one of
+// extensions.
+func readConfigFile(path string, extensions ...string) ([]byte, error) {
+	if !slices.Contains(extensions, strings.ToLower(filepath.Ext(path))) {
+		log.Printf("Config file must end in %s", strings.Join(extensions, " or "))
+		return nil, fmt.Errorf("Config file %s must end in %s", path, strings.Join(extensions, " or "))
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("Error opening config file: %s", path)
+		return nil, err
+	}
+	return data, nil
+}
+
+// reencodeConfig decodes a parsed YAML or TOML document through JSON, so
+// every format matches field names the same way and rejects the same
+// unknown fields.
+func reencodeConfig(path string, doc any) (Config, error) {
+	data, err := json.Marshal(jsonCompatible(doc))
+	if err == nil {
+		var config Config
+		if config, err = decodeConfig(data); err == nil {
+			return config, nil
+		}
+	}
+	log.Printf("Error decoding config file: %s", path)
+	return Config{}, err
+}
+
+// decodeConfig decodes a JSON config, rejecting fields Config does not have
+// so that a typo such as HealthCheckIntervall fails instead of leaving the
+// setting at 0.
+func decodeConfig(data []byte) (Config, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	config := Config{}
+	if err := decoder.Decode(&config); err != nil {
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			return Config{}, errors.New("Unknown config field " + field)
+		}
+		return Config{}, err
+	}
+	if decoder.More() {
+		return Config{}, errors.New("Unexpected data after the config")
+	}
 	return config, nil
 }
 
+// jsonCompatible converts the map[any]any YAML produces for mappings with
+// non-string keys, such as ErrorTemplates, into map[string]any.
+func jsonCompatible(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			v[key] = jsonCompatible(value)
+		}
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = jsonCompatible(value)
+		}
+		return m
+	case []any:
+		for i, value := range v {
+			v[i] = jsonCompatible(value)
+		}
+	}
+	return v
+}
+
+// AllBackends returns InitialAddresses (with weight 1) followed by Backends,
+// with default weights filled in.
+func (c *Config) AllBackends() []Backend {
+	backends := make([]Backend, 0, len(c.InitialAddresses)+len(c.Backends))
+	for _, address := range c.InitialAddresses {
+		backends = append(backends, Backend{Address: address, Weight: 1})
+	}
+	for _, b := range c.Backends {
+		if b.Weight == 0 {
+			b.Weight = 1
+		}
+		backends = append(backends, b)
+	}
+	return backends
+}
+
+// healthCheckTimings are the health check settings of a Config with
+// defaults filled in.
+type healthCheckTimings struct {
+	interval, timeout, unhealthyThreshold, downInterval time.Duration
+}
+
+func (c *Config) healthCheckTimings() healthCheckTimings {
+	return healthCheckTimings{
+		interval:           c.HealthCheckInterval.or(defaultHealthCheckInterval).Duration(),
+		timeout:            c.HealthCheckTimeout.or(defaultHealthCheckTimeout).Duration(),
+		unhealthyThreshold: c.HealthCheckUnhealthyThreshold.or(defaultHealthCheckUnhealthyThreshold).Duration(),
+		downInterval:       c.HealthCheckDownInterval.or(defaultHealthCheckDownInterval).Duration(),
+	}
+}
+
+// backendSchemes are the URL schemes backend addresses may use with each
+// protocol. rpc backends may be given as http or https so a grpc health
+// check knows whether to use TLS.
+var backendSchemes = map[string][]string{
+	"http": {"http", "https"},
+	"rpc":  {"tcp", "http", "https"},
+}
+
+// FieldError is a problem with one setting of a Config. Field is its path,
+// such as Port, Retry or Backends[2].Address.
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateConfig checks c and returns every problem found as a *FieldError,
+// joined with errors.Join, or nil if c is valid.
 func (c *Config) ValidateConfig() error {
-	if len(c.InitialAddresses) == 0 {
-		return errors.New("InitialAddresses cannot be empty")
+	var errs []error
+	check := func(field string, err error) {
+		if err != nil {
+			errs = append(errs, &FieldError{Field: field, Err: err})
+		}
 	}
-	if c.Protocol != "http" && c.Protocol != "rpc" {
-		return errors.New("Unsupported protocol")
+	if len(c.InitialAddresses) == 0 && len(c.Backends) == 0 {
+		check("InitialAddresses", errors.New("InitialAddresses cannot be empty"))
 	}
-	if c.HealthCheckInterval <= 0 {
-		return errors.New("HealthCheckInterval must be positive")
+	if c.Port < 0 || c.Port > 65535 {
+		check("Port", fmt.Errorf("Port %d must be between 0 and 65535", c.Port))
+	}
+	if _, ok := backendSchemes[c.Protocol]; !ok {
+		check("Protocol", errors.New("Unsupported protocol"))
+	}
+	for i, address := range c.InitialAddresses {
+		check(fmt.Sprintf("InitialAddresses[%d]", i), validateBackendAddress(address, c.Protocol))
+	}
+	for i, b := range c.Backends {
+		check(fmt.Sprintf("Backends[%d].Address", i), validateBackendAddress(b.Address, c.Protocol))
+		if err := validateWeight(b.Weight); err != nil {
+			check(fmt.Sprintf("Backends[%d].Weight", i), fmt.Errorf("Backend %s %w", b.Address, err))
+		}
+	}
+	if _, ok := balancers[c.Algorithm]; c.Algorithm != "" && !ok {
+		check("Algorithm", errors.New("Unsupported algorithm"))
+	}
+	if c.DrainStickyGrace < 0 {
+		check("DrainStickyGrace", errors.New("DrainStickyGrace cannot be negative"))
+	}
+	if c.UpstreamTimeout < 0 {
+		check("UpstreamTimeout", errors.New("UpstreamTimeout cannot be negative"))
+	}
+	if c.ShutdownTimeout < 0 {
+		check("ShutdownTimeout", errors.New("ShutdownTimeout cannot be negative"))
+	}
+	// Sections name the field at the start of their messages, such as
+	// "Retry.MaxAttempts cannot be negative".
+	checkSection := func(section string, err error) {
+		field := section
+		if err != nil {
+			if word, _, _ := strings.Cut(err.Error(), " "); strings.HasPrefix(word, section+".") {
+				field = word
+			}
+		}
+		check(field, err)
+	}
+	_, err := newErrorPages(c.ErrorFormat, c.ErrorTemplates)
+	check("ErrorTemplates", err)
+	checkSection("Retry", c.Retry.Validate())
+	checkSection("OutlierDetection", c.OutlierDetection.Validate())
+	checkSection("Notifications", c.Notifications.Validate())
+	if c.AdminAddress != "" {
+		check("AdminAddress", validateAdminAddress(c.AdminAddress, c.AdminToken))
+	}
+	if c.Algorithm == ALGORITHM_CONSISTENT_HASH {
+		_, _, err := parseHashKey(c.HashKey)
+		check("HashKey", err)
+	}
+	if _, ok := checkers[c.HealthCheckType]; c.HealthCheckType != "" && !ok {
+		check("HealthCheckType", errors.New("Unsupported HealthCheckType"))
+	}
+	_, err = newHTTPCheck(c.HealthCheck)
+	checkSection("HealthCheck", err)
+	negative := false
+	for _, timing := range []struct {
+		name  string
+		value Milliseconds
+	}{
+		{"HealthCheckInterval", c.HealthCheckInterval},
+		{"HealthCheckTimeout", c.HealthCheckTimeout},
+		{"HealthCheckUnhealthyThreshold", c.HealthCheckUnhealthyThreshold},
+		{"HealthCheckDownInterval", c.HealthCheckDownInterval},
+	} {
+		if timing.value < 0 {
+			negative = true
+			check(timing.name, errors.New(timing.name+" cannot be negative"))
+		}
+	}
+	// Compared with defaults filled in, so setting only HealthCheckTimeout
+	// to 15s is caught too.
+	if timings := c.healthCheckTimings(); !negative {
+		if timings.timeout >= timings.interval {
+			check("HealthCheckTimeout", fmt.Errorf("HealthCheckTimeout %s must be less than HealthCheckInterval %s", timings.timeout, timings.interval))
+		}
+		if timings.unhealthyThreshold >= timings.timeout {
+			check("HealthCheckUnhealthyThreshold", fmt.Errorf("HealthCheckUnhealthyThreshold %s must be less than HealthCheckTimeout %s", timings.unhealthyThreshold, timings.timeout))
+		}
+	}
+	if c.HealthyThreshold < 0 {
+		check("HealthyThreshold", errors.New("HealthyThreshold cannot be negative"))
+	}
+	if c.UnhealthyThreshold < 0 {
+		check("UnhealthyThreshold", errors.New("UnhealthyThreshold cannot be negative"))
+	}
+	if c.HealthCheckConcurrency < 0 {
+		check("HealthCheckConcurrency", errors.New("HealthCheckConcurrency cannot be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// maxWeight bounds backend weights. consistent_hash places virtualNodes ring
+// points per unit of weight, so an unbounded weight could build a ring of
+// millions of points on the first request.
+const maxWeight = 1000
+
+func validateWeight(weight int) error {
+	if weight < 0 || weight > maxWeight {
+		return fmt.Errorf("Weight %d must be between 0 and %d", weight, maxWeight)
+	}
+	return nil
+}
+
+// validateBackendAddress checks that address is a URL with a host and one of
+// the schemes protocol allows. rpc backends are dialled as they are, so they
+// also need a port.
+func validateBackendAddress(address, protocol string) error {
+	if address == "" {
+		return errors.New("Backend Address cannot be empty")
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return fmt.Errorf("Backend %s is not a valid URL: %s", address, err)
 	}
-	if c.HealthCheckTimeout <= 0 {
-		return errors.New("HealthCheckTimeout must be positive")
+	if u.Host == "" {
+		return fmt.Errorf("Backend %s has no host, expected e.g. http://10.0.0.1:8080", address)
 	}
-	if c.HealthCheckUnhealthyThreshold <= 0 {
-		return errors.New("HealthCheckUnhealthyThreshold must be positive")
+	schemes := backendSchemes[protocol]
+	if schemes != nil && !slices.Contains(schemes, u.Scheme) {
+		last := len(schemes) - 1
+		return fmt.Errorf("Backend %s must use %s", address, strings.Join(schemes[:last], ", ")+" or "+schemes[last])
 	}
-	if c.HealthCheckDownInterval <= 0 {
-		return errors.New("HealthCheckDownInterval must be positive")
+	if protocol == "rpc" && u.Port() == "" {
+		return fmt.Errorf("Backend %s has no port, expected e.g. tcp://10.0.0.1:9000", address)
 	}
 	return nil
 }
@@ -5,6 +5,9 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -85,3 +88,154 @@ func TestReadConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestConfigFormats(t *testing.T) {
+	log.SetOutput(io.Discard)
+	write := func(t *testing.T, name, content string) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+		return path
+	}
+	want := Config{
+		Host:                "localhost",
+		Port:                8080,
+		InitialAddresses:    []string{"http://a.example", "http://b.example"},
+		Backends:            []Backend{{Address: "http://c.example", Weight: 2}},
+		Protocol:            "http",
+		ErrorTemplates:      map[int]string{502: "bad gateway"},
+		Retry:               RetryPolicy{MaxAttempts: 2},
+		HealthCheckInterval: 1000,
+	}
+	formats := map[string]string{
+		"config.json": `{
+			"Host": "localhost",
+			"Port": 8080,
+			"InitialAddresses": ["http://a.example", "http://b.example"],
+			"Backends": [{"Address": "http://c.example", "Weight": 2}],
+			"Protocol": "http",
+			"ErrorTemplates": {"502": "bad gateway"},
+			"Retry": {"MaxAttempts": 2},
+			"HealthCheckInterval": 1000
+		}`,
+		"config.yaml": `
+Host: localhost
+Port: 8080
+InitialAddresses:
+  - http://a.example
+  - http://b.example
+Backends:
+  - Address: http://c.example
+    Weight: 2
+Protocol: http
+ErrorTemplates:
+  502: bad gateway
+Retry:
+  MaxAttempts: 2
+HealthCheckInterval: 1000
+`,
+		"config.toml": `
+Host = "localhost"
+Port = 8080
+InitialAddresses = ["http://a.example", "http://b.example"]
+Protocol = "http"
+HealthCheckInterval = 1000
+
+[[Backends]]
+Address = "http://c.example"
+Weight = 2
+
+[ErrorTemplates]
+502 = "bad gateway"
+
+[Retry]
+MaxAttempts = 2
+`,
+	}
+
+	t.Run("TestSameConfig", func(t *testing.T) {
+		for name, content := range formats {
+			reader, err := NewConfigReader(write(t, name, content))
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			got, err := reader.ReadConfig()
+			if err != nil {
+				t.Fatalf("%s: ReadConfig() error = %v", name, err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: expected %+v, got %+v", name, want, got)
+			}
+		}
+	})
+
+	t.Run("TestDurations", func(t *testing.T) {
+		durations := map[string]string{
+			"durations.json": `{"HealthCheckInterval": "5s", "HealthCheckTimeout": 1500, "HealthCheckDownInterval": "1m30s", "ShutdownTimeout": "5s", "Retry": {"PerTryTimeout": "250ms"}}`,
+			"durations.yaml": "HealthCheckInterval: 5s\nHealthCheckTimeout: 1500\nHealthCheckDownInterval: 1m30s\nShutdownTimeout: 5s\nRetry:\n  PerTryTimeout: 250ms\n",
+			"durations.toml": "HealthCheckInterval = \"5s\"\nHealthCheckTimeout = 1500\nHealthCheckDownInterval = \"1m30s\"\nShutdownTimeout = \"5s\"\n\n[Retry]\nPerTryTimeout = \"250ms\"\n",
+		}
+		for name, content := range durations {
+			reader, err := NewConfigReader(write(t, name, content))
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			got, err := reader.ReadConfig()
+			if err != nil {
+				t.Fatalf("%s: ReadConfig() error = %v", name, err)
+			}
+			if got.HealthCheckInterval != 5000 || got.HealthCheckTimeout != 1500 || got.HealthCheckDownInterval != 90000 {
+				t.Errorf("%s: unexpected durations %d, %d and %d", name, got.HealthCheckInterval, got.HealthCheckTimeout, got.HealthCheckDownInterval)
+			}
+			if got.ShutdownTimeout != 5000 || got.Retry.PerTryTimeout != 250 {
+				t.Errorf("%s: unexpected ShutdownTimeout %d and Retry.PerTryTimeout %d", name, got.ShutdownTimeout, got.Retry.PerTryTimeout)
+			}
+		}
+		for _, value := range []string{`"5 parsecs"`, `"1.5ms"`, `true`, `1.5`} {
+			path := write(t, "bad.json", `{"HealthCheckInterval": `+value+`}`)
+			if _, err := (&JsonConfigReader{Path: path}).ReadConfig(); err == nil {
+				t.Errorf("expected HealthCheckInterval %s to be rejected", value)
+			}
+		}
+	})
+
+	t.Run("TestUnknownFields", func(t *testing.T) {
+		typos := map[string]string{
+			"typo.json": `{"Protocol": "http", "HealthCheckIntervall": 1000}`,
+			"typo.yaml": "Protocol: http\nHealthCheckIntervall: 1000\n",
+			"typo.yml":  "Retry:\n  MaxAttemps: 2\n",
+			"typo.toml": "Protocol = \"http\"\nHealthCheckIntervall = 1000\n",
+		}
+		for name, content := range typos {
+			reader, err := NewConfigReader(write(t, name, content))
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if _, err := reader.ReadConfig(); err == nil || !strings.Contains(err.Error(), "Intervall") && !strings.Contains(err.Error(), "MaxAttemps") {
+				t.Errorf("%s: expected unknown field error, got %v", name, err)
+			}
+		}
+	})
+
+	t.Run("TestExtensions", func(t *testing.T) {
+		if _, err := NewConfigReader("config.ini"); err == nil {
+			t.Errorf("expected unsupported extension to be rejected")
+		}
+		if reader, err := NewConfigReader("CONFIG.YML"); err != nil {
+			t.Errorf("expected extension to be case-insensitive, got %v", err)
+		} else if _, ok := reader.(*YamlConfigReader); !ok {
+			t.Errorf("expected a YamlConfigReader, got %T", reader)
+		}
+		// Short names used to slip past the .json check.
+		for _, path := range []string{write(t, "a.js", "{}"), write(t, "config.yaml", "{}")} {
+			if _, err := (&JsonConfigReader{Path: path}).ReadConfig(); err == nil {
+				t.Errorf("expected JsonConfigReader to reject %s", filepath.Base(path))
+			}
+		}
+		if _, err := (&JsonConfigReader{Path: write(t, "x.json", "{}")}).ReadConfig(); err != nil {
+			t.Errorf("expected short .json name to be accepted, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HashKey sources for the consistent_hash algorithm. Header and cookie take
+// the name after a colon, e.g. "header:X-User-Id" or "cookie:session".
+const (
+	HASH_KEY_IP     = "ip"
+	HASH_KEY_PATH   = "path"
+	HASH_KEY_HEADER = "header"
+	HASH_KEY_COOKIE = "cookie"
+)
+
+// virtualNodes is the number of ring points per unit of backend weight, so a
+// host has at most virtualNodes*maxWeight of them.
+const virtualNodes = 160
+
+// parseHashKey splits a HashKey setting into its source and name. An empty
+// setting hashes on the client IP.
+func parseHashKey(key string) (string, string, error) {
+	if key == "" {
+		return HASH_KEY_IP, "", nil
+	}
+	source, name, _ := strings.Cut(key, ":")
+	switch source {
+	case HASH_KEY_IP, HASH_KEY_PATH:
+		if name != "" {
+			return "", "", errors.New("HashKey " + source + " does not take a name")
+		}
+	case HASH_KEY_HEADER, HASH_KEY_COOKIE:
+		if name == "" {
+			return "", "", errors.New("HashKey " + source + " requires a name, e.g. " + source + ":name")
+		}
+	default:
+		return "", "", errors.New("Unsupported HashKey: " + key)
+	}
+	return source, name, nil
+}
+
+// consistentHashBalancer maps each request key onto a ring of virtual nodes.
+// The ring always contains every configured host; unavailable ones are
+// skipped while walking it, so only a down host's keys move to its
+// neighbours and they return once it recovers. Requests without a key fall
+// back to round-robin.
+type consistentHashBalancer struct {
+	source string
+	name   string
+	rr     *roundRobinBalancer
+
+	mu   sync.Mutex
+	ring atomic.Pointer[hashRing]
+}
+
+type hashRing struct {
+	signature uint64
+	points    []ringPoint
+}
+
+// ringPoint is a virtual node; index refers to the host slice the ring was
+// built from, which is stable for as long as the signature matches.
+type ringPoint struct {
+	hash  uint64
+	index int
+}
+
+func newConsistentHashBalancer(config *Config) (Balancer, error) {
+	source, name, err := parseHashKey(config.HashKey)
+	if err != nil {
+		return nil, err
+	}
+	return &consistentHashBalancer{source: source, name: name, rr: newRoundRobinBalancer()}, nil
+}
+
+func (b *consistentHashBalancer) Pick(r *http.Request, hosts []HostState) string {
+	key, ok := b.requestKey(r)
+	if !ok {
+		return b.rr.Pick(r, hosts)
+	}
+	ring := b.ringOf(hosts).points
+	hash := hashString(key)
+	start := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+	for i := 0; i < len(ring); i++ {
+		if h := hosts[ring[(start+i)%len(ring)].index]; h.Available() {
+			return h.Address
+		}
+	}
+	return ""
+}
+
+func (b *consistentHashBalancer) Done(string, time.Duration, error) {}
+
+func (b *consistentHashBalancer) requestKey(r *http.Request) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	switch b.source {
+	case HASH_KEY_IP:
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		return host, host != ""
+	case HASH_KEY_PATH:
+		if r.URL == nil {
+			return "", false
+		}
+		return r.URL.Path, true
+	case HASH_KEY_HEADER:
+		value := r.Header.Get(b.name)
+		return value, value != ""
+	case HASH_KEY_COOKIE:
+		cookie, err := r.Cookie(b.name)
+		if err != nil || cookie.Value == "" {
+			return "", false
+		}
+		return cookie.Value, true
+	}
+	return "", false
+}
+
+// ringOf returns the ring for hosts, rebuilding it only when the set of
+// hosts or their weights changed.
+func (b *consistentHashBalancer) ringOf(hosts []HostState) *hashRing {
+	signature := uint64(len(hosts))
+	for _, h := range hosts {
+		signature = signature*31 + hashString(h.Address) + uint64(h.Weight)
+	}
+	if ring := b.ring.Load(); ring != nil && ring.signature == signature {
+		return ring
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ring := b.ring.Load(); ring != nil && ring.signature == signature {
+		return ring
+	}
+	ring := &hashRing{signature: signature}
+	for i, h := range hosts {
+		for v := 0; v < virtualNodes*h.Weight; v++ {
+			ring.points = append(ring.points, ringPoint{hash: hashString(h.Address + "#" + strconv.Itoa(v)), index: i})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i].hash < ring.points[j].hash })
+	b.ring.Store(ring)
+	return ring
+}
+
+// hashString is 64-bit FNV-1a followed by a murmur3 finalizer, which spreads
+// the near-identical virtual node names evenly around the ring.
+func hashString(s string) uint64 {
+	x := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		x ^= uint64(s[i])
+		x *= 1099511628211
+	}
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
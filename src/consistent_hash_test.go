@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestConsistentHash(t *testing.T) {
+	config := &Config{
+		InitialAddresses: []string{"http://a.example", "http://b.example", "http://c.example"},
+		Algorithm:        ALGORITHM_CONSISTENT_HASH,
+		HashKey:          "header:X-User",
+	}
+	requestFor := func(user string) *http.Request {
+		r, _ := http.NewRequest(http.MethodGet, "http://lb/", nil)
+		r.Header.Set("X-User", user)
+		return r
+	}
+	pickAll := func(lb *LoadBalancer) map[string]string {
+		picks := map[string]string{}
+		for i := 0; i < 300; i++ {
+			user := fmt.Sprintf("user-%d", i)
+			host, _ := lb.nextBackend(requestFor(user))
+			picks[user] = host
+		}
+		return picks
+	}
+
+	t.Run("TestSameKeySameHost", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, config)
+		first, _ := lb.nextBackend(requestFor("alice"))
+		for i := 0; i < 10; i++ {
+			if host, _ := lb.nextBackend(requestFor("alice")); host != first {
+				t.Fatalf("expected %s on every pick, got %s", first, host)
+			}
+		}
+	})
+
+	t.Run("TestSpreadsKeys", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, config)
+		counts := map[string]int{}
+		for _, host := range pickAll(lb) {
+			counts[host]++
+		}
+		for _, host := range config.InitialAddresses {
+			if counts[host] < 50 {
+				t.Errorf("expected keys spread over all hosts, got %v", counts)
+			}
+		}
+	})
+
+	t.Run("TestOnlyDownHostKeysMove", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, config)
+		before := pickAll(lb)
+
+		lb.HostStatus.Store("http://b.example", HTTP_STATUS_DOWN)
+		during := pickAll(lb)
+		for user, host := range before {
+			if host != "http://b.example" && during[user] != host {
+				t.Errorf("%s moved from %s to %s although its host stayed up", user, host, during[user])
+			}
+			if during[user] == "http://b.example" {
+				t.Errorf("%s still routed to down host", user)
+			}
+		}
+
+		lb.HostStatus.Store("http://b.example", HTTP_STATUS_HEALTHY)
+		after := pickAll(lb)
+		for user, host := range before {
+			if after[user] != host {
+				t.Errorf("%s did not return to %s after recovery, got %s", user, host, after[user])
+			}
+		}
+	})
+
+	t.Run("TestMissingKeyFallsBack", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, config)
+		r, _ := http.NewRequest(http.MethodGet, "http://lb/", nil)
+		if host, _ := lb.nextBackend(r); host == "" {
+			t.Errorf("expected a host for request without key")
+		}
+	})
+
+	t.Run("TestKeySources", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodGet, "http://lb/users/42", nil)
+		r.RemoteAddr = "10.0.0.7:5555"
+		r.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+		r.Header.Set("X-User", "bob")
+		tests := []struct {
+			hashKey string
+			want    string
+		}{
+			{"", "10.0.0.7"},
+			{"ip", "10.0.0.7"},
+			{"path", "/users/42"},
+			{"header:X-User", "bob"},
+			{"cookie:session", "abc"},
+		}
+		for _, tt := range tests {
+			b, err := newConsistentHashBalancer(&Config{HashKey: tt.hashKey})
+			if err != nil {
+				t.Fatalf("HashKey %q: unexpected error %v", tt.hashKey, err)
+			}
+			if key, _ := b.(*consistentHashBalancer).requestKey(r); key != tt.want {
+				t.Errorf("HashKey %q: expected key %q, got %q", tt.hashKey, tt.want, key)
+			}
+		}
+	})
+
+	t.Run("TestInvalidHashKey", func(t *testing.T) {
+		for _, key := range []string{"header", "cookie:", "ip:x", "query:id"} {
+			cfg := Config{InitialAddresses: []string{"http://a.example"}, Protocol: "http", Algorithm: ALGORITHM_CONSISTENT_HASH, HashKey: key,
+				HealthCheckInterval: 1000, HealthCheckTimeout: 500, HealthCheckUnhealthyThreshold: 200, HealthCheckDownInterval: 1000}
+			if err := cfg.ValidateConfig(); err == nil {
+				t.Errorf("expected HashKey %q to be rejected", key)
+			}
+		}
+	})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWebhookRetries                   = 3
+	defaultNotificationTimeout Milliseconds = 5000
+	// eventQueueSize is how many events a slow subscriber may fall behind
+	// before further events to it are dropped.
+	eventQueueSize = 256
+)
+
+// Notifications configures who hears about host status changes besides the
+// log.
+type Notifications struct {
+	WebhookURL     string       // receives each StatusEvent as a JSON POST
+	WebhookRetries int          // extra attempts after a failed POST, default 3
+	ExecCommand    []string     // command and arguments run for each StatusEvent, with the event as JSON on stdin
+	Timeout        Milliseconds // per webhook attempt or command run, default 5s
+}
+
+func (n *Notifications) Validate() error {
+	if n.WebhookURL != "" {
+		u, err := url.Parse(n.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("Notifications.WebhookURL must be an absolute http or https URL")
+		}
+	}
+	if n.WebhookRetries < 0 {
+		return errors.New("Notifications.WebhookRetries cannot be negative")
+	}
+	if n.Timeout < 0 {
+		return errors.New("Notifications.Timeout cannot be negative")
+	}
+	return nil
+}
+
+// StatusEvent records one host changing status.
+type StatusEvent struct {
+	Host      string
+	OldStatus string
+	NewStatus string
+	Reason    string
+	Latency   time.Duration // of the check that caused the change, 0 if none
+	Time      time.Time
+}
+
+// statusEventJSON is the wire form of a StatusEvent for webhooks and exec
+// hooks.
+type statusEventJSON struct {
+	Host      string  `json:"host"`
+	OldStatus string  `json:"old_status"`
+	NewStatus string  `json:"new_status"`
+	Reason    string  `json:"reason"`
+	LatencyMs float64 `json:"latency_ms"`
+	Time      string  `json:"time"`
+}
+
+func (e StatusEvent) MarshalJSON() ([]byte, error) {
+	return json.Marshal(statusEventJSON{
+		Host:      e.Host,
+		OldStatus: e.OldStatus,
+		NewStatus: e.NewStatus,
+		Reason:    e.Reason,
+		LatencyMs: float64(e.Latency) / float64(time.Millisecond),
+		Time:      e.Time.UTC().Format(time.RFC3339Nano),
+	})
+}
+
+// eventBus fans status events out to subscribers. Every subscriber has its
+// own queue and goroutine, so a slow webhook never delays health checks or
+// other subscribers.
+type eventBus struct {
+	mu     sync.Mutex
+	queues []chan StatusEvent
+}
+
+// subscribe calls handler for every event published from now on, in order.
+func (b *eventBus) subscribe(handler func(StatusEvent)) {
+	queue := make(chan StatusEvent, eventQueueSize)
+	b.mu.Lock()
+	b.queues = append(b.queues, queue)
+	b.mu.Unlock()
+	go func() {
+		for event := range queue {
+			handler(event)
+		}
+	}()
+}
+
+func (b *eventBus) publish(event StatusEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, queue := range b.queues {
+		select {
+		case queue <- event:
+		default:
+			log.Printf("Dropping status event for %s: subscriber is %d events behind", event.Host, eventQueueSize)
+		}
+	}
+}
+
+// Subscribe calls handler for every host status change from now on. Handlers
+// run on their own goroutine, one event at a time.
+func (l *LoadBalancer) Subscribe(handler func(StatusEvent)) {
+	l.events.subscribe(handler)
+}
+
+// publishStatus announces that host went from old to next.
+func (l *LoadBalancer) publishStatus(host, old, next, reason string, latency time.Duration) {
+	l.events.publish(StatusEvent{Host: host, OldStatus: old, NewStatus: next, Reason: reason, Latency: latency, Time: time.Now()})
+}
+
+// newEventBus subscribes the structured log and any configured notifiers.
+func newEventBus(config Notifications) *eventBus {
+	bus := &eventBus{}
+	bus.subscribe(logStatusEvent)
+	timeout := config.Timeout.or(defaultNotificationTimeout).Duration()
+	if config.WebhookURL != "" {
+		retries := config.WebhookRetries
+		if retries == 0 {
+			retries = defaultWebhookRetries
+		}
+		webhook := &webhookNotifier{url: config.WebhookURL, retries: retries, backoff: 500 * time.Millisecond, client: &http.Client{Timeout: timeout}}
+		bus.subscribe(webhook.notify)
+	}
+	if len(config.ExecCommand) > 0 {
+		hook := &execNotifier{command: config.ExecCommand, timeout: timeout}
+		bus.subscribe(hook.notify)
+	}
+	return bus
+}
+
+func logStatusEvent(e StatusEvent) {
+	level := slog.LevelInfo
+	if e.NewStatus == HTTP_STATUS_DOWN || e.NewStatus == HTTP_STATUS_EJECTED {
+		level = slog.LevelWarn
+	}
+	slog.Log(context.Background(), level, "host status changed",
+		"host", e.Host,
+		"old", e.OldStatus,
+		"new", e.NewStatus,
+		"reason", e.Reason,
+		"latency", e.Latency,
+	)
+}
+
+// webhookNotifier POSTs events as JSON, retrying failed deliveries with
+// exponential backoff.
+type webhookNotifier struct {
+	url     string
+	retries int
+	backoff time.Duration
+	client  *http.Client
+}
+
+func (w *webhookNotifier) notify(e StatusEvent) {
+	body, _ := json.Marshal(e)
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		err := w.post(body)
+		if err == nil {
+			return
+		}
+		if attempt >= w.retries {
+			log.Printf("Giving up on webhook for %s after %d attempts: %s", e.Host, attempt+1, err)
+			return
+		}
+		log.Printf("Webhook for %s failed, retrying in %s: %s", e.Host, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (w *webhookNotifier) post(body []byte) error {
+	res, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// execNotifier runs a local command per event. The event is written to its
+// stdin as JSON and also passed in GLB_* environment variables.
+type execNotifier struct {
+	command []string
+	timeout time.Duration
+}
+
+func (x *execNotifier) notify(e StatusEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), x.timeout)
+	defer cancel()
+	body, _ := json.Marshal(e)
+	cmd := exec.CommandContext(ctx, x.command[0], x.command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"GLB_HOST="+e.Host,
+		"GLB_OLD_STATUS="+e.OldStatus,
+		"GLB_NEW_STATUS="+e.NewStatus,
+		"GLB_REASON="+e.Reason,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("Status hook %s failed for %s: %s: %s", x.command[0], e.Host, err, out)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStatusEvents(t *testing.T) {
+	host := "http://a.example"
+
+	t.Run("TestPublishesTransitions", func(t *testing.T) {
+		lb, err := NewLoadBalancer(&Config{
+			InitialAddresses: []string{host},
+			OutlierDetection: OutlierDetection{ConsecutiveFailures: 1, BaseEjectionTime: 50},
+		})
+		if err != nil {
+			t.Fatalf("Failed to create LoadBalancer: %v", err)
+		}
+		events := make(chan StatusEvent, 10)
+		lb.Subscribe(func(e StatusEvent) { events <- e })
+
+		lb.recordCheck(host, HTTP_STATUS_HEALTHY, 3*time.Millisecond, "health check passed")
+		lb.recordCheck(host, HTTP_STATUS_HEALTHY, 3*time.Millisecond, "health check passed")
+		lb.outliers.record(host, true)
+		want := []StatusEvent{
+			{Host: host, OldStatus: HTTP_STATUS_UNKNOWN, NewStatus: HTTP_STATUS_HEALTHY, Reason: "health check passed", Latency: 3 * time.Millisecond},
+			{Host: host, OldStatus: HTTP_STATUS_HEALTHY, NewStatus: HTTP_STATUS_EJECTED, Reason: "1 consecutive failed requests"},
+			{Host: host, OldStatus: HTTP_STATUS_EJECTED, NewStatus: HTTP_STATUS_HEALTHY, Reason: "ejection expired"},
+		}
+		for i, w := range want {
+			select {
+			case got := <-events:
+				if got.Time.IsZero() {
+					t.Errorf("event %d has no timestamp", i)
+				}
+				got.Time = time.Time{}
+				if got != w {
+					t.Errorf("event %d: expected %+v, got %+v", i, w, got)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("event %d not delivered", i)
+			}
+		}
+		select {
+		case got := <-events:
+			t.Errorf("unexpected event %+v", got)
+		case <-time.After(20 * time.Millisecond):
+		}
+	})
+
+	t.Run("TestForcedHostFollowsHostStatus", func(t *testing.T) {
+		lb, err := NewLoadBalancer(&Config{InitialAddresses: []string{host}})
+		if err != nil {
+			t.Fatalf("Failed to create LoadBalancer: %v", err)
+		}
+		events := make(chan StatusEvent, 10)
+		lb.Subscribe(func(e StatusEvent) { events <- e })
+
+		lb.ForceStatus(host, HTTP_STATUS_DOWN)
+		lb.recordCheck(host, HTTP_STATUS_HEALTHY, 3*time.Millisecond, "health check passed")
+		lb.ForceStatus(host, "")
+		want := []StatusEvent{
+			{Host: host, OldStatus: HTTP_STATUS_UNKNOWN, NewStatus: HTTP_STATUS_DOWN, Reason: "forced " + HTTP_STATUS_DOWN},
+			{Host: host, OldStatus: HTTP_STATUS_DOWN, NewStatus: HTTP_STATUS_HEALTHY, Reason: "returned to health checks"},
+		}
+		for i, w := range want {
+			select {
+			case got := <-events:
+				got.Time = time.Time{}
+				if got != w {
+					t.Errorf("event %d: expected %+v, got %+v", i, w, got)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("event %d not delivered", i)
+			}
+		}
+		select {
+		case got := <-events:
+			t.Errorf("unexpected event %+v", got)
+		case <-time.After(20 * time.Millisecond):
+		}
+	})
+
+	event := StatusEvent{Host: host, OldStatus: HTTP_STATUS_HEALTHY, NewStatus: HTTP_STATUS_DOWN, Reason: "connection refused", Latency: 1500 * time.Microsecond, Time: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+
+	t.Run("TestWebhookRetries", func(t *testing.T) {
+		var hits atomic.Int64
+		var mu sync.Mutex
+		var body []byte
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if hits.Add(1) < 3 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			mu.Lock()
+			body, _ = io.ReadAll(r.Body)
+			mu.Unlock()
+		}))
+		defer server.Close()
+
+		webhook := &webhookNotifier{url: server.URL, retries: 3, backoff: time.Millisecond, client: server.Client()}
+		webhook.notify(event)
+		if got := hits.Load(); got != 3 {
+			t.Errorf("expected delivery on the third attempt, got %d attempts", got)
+		}
+		var payload statusEventJSON
+		mu.Lock()
+		defer mu.Unlock()
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Fatalf("webhook body is not JSON: %q", body)
+		}
+		want := statusEventJSON{Host: host, OldStatus: HTTP_STATUS_HEALTHY, NewStatus: HTTP_STATUS_DOWN, Reason: "connection refused", LatencyMs: 1.5, Time: "2024-05-01T12:00:00Z"}
+		if payload != want {
+			t.Errorf("expected payload %+v, got %+v", want, payload)
+		}
+	})
+
+	t.Run("TestWebhookGivesUp", func(t *testing.T) {
+		var hits atomic.Int64
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer server.Close()
+
+		webhook := &webhookNotifier{url: server.URL, retries: 2, backoff: time.Millisecond, client: server.Client()}
+		webhook.notify(event)
+		if got := hits.Load(); got != 3 {
+			t.Errorf("expected 3 attempts, got %d", got)
+		}
+	})
+
+	t.Run("TestExecHook", func(t *testing.T) {
+		out := filepath.Join(t.TempDir(), "event")
+		hook := &execNotifier{command: []string{"sh", "-c", `{ echo "$GLB_NEW_STATUS"; cat; } > "$0"`, out}, timeout: time.Second}
+		hook.notify(event)
+		written, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatalf("hook did not run: %v", err)
+		}
+		status, body, _ := strings.Cut(string(written), "\n")
+		if status != HTTP_STATUS_DOWN {
+			t.Errorf("expected GLB_NEW_STATUS %s, got %q", HTTP_STATUS_DOWN, status)
+		}
+		if !strings.Contains(body, `"reason":"connection refused"`) {
+			t.Errorf("expected event JSON on stdin, got %q", body)
+		}
+	})
+
+	t.Run("TestInvalidNotifications", func(t *testing.T) {
+		invalid := []Notifications{
+			{WebhookURL: "hooks.example/glb"},
+			{WebhookURL: "ftp://hooks.example/glb"},
+			{WebhookRetries: -1},
+			{Timeout: -1},
+		}
+		for _, n := range invalid {
+			if err := n.Validate(); err == nil {
+				t.Errorf("expected error for invalid notifications: %+v", n)
+			}
+		}
+	})
+}
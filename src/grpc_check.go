@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const HEALTH_CHECK_GRPC = "grpc"
+
+// GRPCHealthCheck configures the grpc HealthCheckType, which calls
+// grpc.health.v1.Health/Check on every backend. Backends are dialled over
+// h2c unless TLS is set or their address uses the https scheme.
+type GRPCHealthCheck struct {
+	Service            string // service name to ask about, empty asks about the server as a whole
+	TLS                bool
+	InsecureSkipVerify bool   // TLS only: accept any backend certificate
+	ServerName         string // TLS only: name to verify the certificate against, default the backend host
+}
+
+// grpcChecker passes a host only if it reports SERVING. NOT_SERVING, UNKNOWN
+// and SERVICE_UNKNOWN all fail the check and count towards HTTP_STATUS_DOWN;
+// latency is classified like any other check. Connections are kept open
+// between checks.
+type grpcChecker struct {
+	config GRPCHealthCheck
+	mu     sync.Mutex
+	conns  map[string]*grpc.ClientConn
+}
+
+func newGRPCChecker(config *Config) (Checker, error) {
+	return &grpcChecker{config: config.GRPCHealthCheck, conns: map[string]*grpc.ClientConn{}}, nil
+}
+
+func (c *grpcChecker) Check(ctx context.Context, host string) (time.Duration, error) {
+	conn, err := c.conn(host)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	res, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: c.config.Service})
+	if err != nil {
+		return 0, err
+	}
+	timedelta := time.Since(start)
+	if status := res.GetStatus(); status != healthpb.HealthCheckResponse_SERVING {
+		return 0, fmt.Errorf("service %q is %s", c.config.Service, status)
+	}
+	return timedelta, nil
+}
+
+func (c *grpcChecker) conn(host string) (*grpc.ClientConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if conn, ok := c.conns[host]; ok {
+		return conn, nil
+	}
+	target, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	creds := insecure.NewCredentials()
+	if c.config.TLS || target.Scheme == "https" {
+		creds = credentials.NewTLS(&tls.Config{
+			ServerName:         c.config.ServerName,
+			InsecureSkipVerify: c.config.InsecureSkipVerify,
+		})
+	}
+	conn, err := grpc.NewClient(target.Host, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	c.conns[host] = conn
+	return conn, nil
+}
+
+// Forget closes the connection to a host that is no longer checked.
+func (c *grpcChecker) Forget(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if conn, ok := c.conns[host]; ok {
+		conn.Close()
+		delete(c.conns, host)
+	}
+}
+
+// Close closes the cached connections. Reload calls it on the checker it
+// replaces, and Shutdown on the one in use.
+func (c *grpcChecker) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for host, conn := range c.conns {
+		conn.Close()
+		delete(c.conns, host)
+	}
+	return nil
+}
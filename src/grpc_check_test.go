@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"maps"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// startHealthServer runs an in-process gRPC server exposing the standard
+// health service and returns its address.
+func startHealthServer(t *testing.T, opts ...grpc.ServerOption) (string, *health.Server) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := grpc.NewServer(opts...)
+	status := health.NewServer()
+	healthpb.RegisterHealthServer(server, status)
+	go server.Serve(ln)
+	t.Cleanup(server.Stop)
+	return ln.Addr().String(), status
+}
+
+func TestGRPCHealthCheck(t *testing.T) {
+	check := func(t *testing.T, host string, spec GRPCHealthCheck) any {
+		t.Helper()
+		lb, err := NewLoadBalancer(&Config{
+			InitialAddresses:              []string{host},
+			HealthCheckType:               HEALTH_CHECK_GRPC,
+			GRPCHealthCheck:               spec,
+			HealthCheckTimeout:            1000,
+			HealthCheckUnhealthyThreshold: 1000,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create LoadBalancer: %v", err)
+		}
+		lb.checkHost(context.Background(), host)
+		status, _ := lb.HostStatus.Load(host)
+		return status
+	}
+
+	t.Run("TestH2C", func(t *testing.T) {
+		addr, status := startHealthServer(t)
+		host := "http://" + addr
+		status.SetServingStatus("orders", healthpb.HealthCheckResponse_SERVING)
+		if got := check(t, host, GRPCHealthCheck{}); got != HTTP_STATUS_HEALTHY {
+			t.Errorf("expected server to be healthy, got %v", got)
+		}
+		if got := check(t, host, GRPCHealthCheck{Service: "orders"}); got != HTTP_STATUS_HEALTHY {
+			t.Errorf("expected serving service to be healthy, got %v", got)
+		}
+		status.SetServingStatus("orders", healthpb.HealthCheckResponse_NOT_SERVING)
+		if got := check(t, host, GRPCHealthCheck{Service: "orders"}); got != HTTP_STATUS_DOWN {
+			t.Errorf("expected NOT_SERVING to be down, got %v", got)
+		}
+		status.SetServingStatus("orders", healthpb.HealthCheckResponse_UNKNOWN)
+		if got := check(t, host, GRPCHealthCheck{Service: "orders"}); got != HTTP_STATUS_DOWN {
+			t.Errorf("expected UNKNOWN to be down, got %v", got)
+		}
+		if got := check(t, host, GRPCHealthCheck{Service: "payments"}); got != HTTP_STATUS_DOWN {
+			t.Errorf("expected unregistered service to be down, got %v", got)
+		}
+	})
+
+	t.Run("TestTLS", func(t *testing.T) {
+		addr, _ := startHealthServer(t, grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}})))
+		if got := check(t, "https://"+addr, GRPCHealthCheck{InsecureSkipVerify: true}); got != HTTP_STATUS_HEALTHY {
+			t.Errorf("expected TLS server to be healthy, got %v", got)
+		}
+		if got := check(t, "http://"+addr, GRPCHealthCheck{TLS: true}); got != HTTP_STATUS_DOWN {
+			t.Errorf("expected untrusted certificate to fail, got %v", got)
+		}
+	})
+
+	t.Run("TestUnreachable", func(t *testing.T) {
+		ln, _ := net.Listen("tcp", "127.0.0.1:0")
+		host := "http://" + ln.Addr().String()
+		ln.Close()
+		if got := check(t, host, GRPCHealthCheck{}); got != HTTP_STATUS_DOWN {
+			t.Errorf("expected closed port to be down, got %v", got)
+		}
+	})
+
+	t.Run("TestConnectionsClosed", func(t *testing.T) {
+		addrA, _ := startHealthServer(t)
+		addrB, _ := startHealthServer(t)
+		a, b := "http://"+addrA, "http://"+addrB
+		lb, err := NewLoadBalancer(&Config{
+			InitialAddresses:    []string{a, b},
+			HealthCheckType:     HEALTH_CHECK_GRPC,
+			HealthCheckInterval: 20,
+			HealthCheckTimeout:  10,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create LoadBalancer: %v", err)
+		}
+		checker := lb.current().checker.(*grpcChecker)
+		conns := func() map[string]*grpc.ClientConn {
+			checker.mu.Lock()
+			defer checker.mu.Unlock()
+			return maps.Clone(checker.conns)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		lb.StartHealthChecks(ctx)
+		for i := 0; i < 100 && len(conns()) < 2; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		kept := conns()
+		if len(kept) != 2 {
+			t.Fatalf("expected connections to both hosts, got %v", kept)
+		}
+
+		if err := lb.RemoveBackend(a); err != nil {
+			t.Fatalf("RemoveBackend failed: %v", err)
+		}
+		for i := 0; i < 100 && len(conns()) == 2; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := conns(); len(got) != 1 || got[b] == nil {
+			t.Errorf("expected only %s to stay connected, got %v", b, got)
+		}
+		if state := kept[a].GetState(); state != connectivity.Shutdown {
+			t.Errorf("expected connection to removed host to be closed, got %s", state)
+		}
+
+		lb.Shutdown(context.Background())
+		if got := conns(); len(got) != 0 {
+			t.Errorf("expected Shutdown to close every connection, got %v", got)
+		}
+		if state := kept[b].GetState(); state != connectivity.Shutdown {
+			t.Errorf("expected connection to be closed on shutdown, got %s", state)
+		}
+	})
+}
+
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "glb-test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
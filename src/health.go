@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// HealthState is what health checks currently know about one backend.
+type HealthState struct {
+	Status    string // HTTP_STATUS_* as decided by health checks alone
+	Successes int    // consecutive passing checks
+	Failures  int    // consecutive failing checks
+	LastCheck time.Time
+	Forced    string // status set through ForceStatus, overriding Status, "" if none
+	ForcedAt  time.Time
+}
+
+// published is the status HostStatus shows for a host in this state, ejection
+// aside.
+func (s HealthState) published() string {
+	if s.Forced != "" {
+		return s.Forced
+	}
+	return s.Status
+}
+
+// hostHealth applies HAProxy-style rise/fall thresholds to health check
+// results: a down host needs HealthyThreshold passing checks in a row to come
+// back, and a live host needs UnhealthyThreshold failures in a row to go down.
+// A host that has never been checked takes the first result as-is.
+type hostHealth struct {
+	mu    sync.Mutex
+	state HealthState
+}
+
+func newHostHealth() *hostHealth {
+	return &hostHealth{state: HealthState{Status: HTTP_STATUS_UNKNOWN}}
+}
+
+// record applies one check result and returns the status to publish, which
+// is the forced status if there is one. result is HTTP_STATUS_HEALTHY or
+// HTTP_STATUS_HIGH_LATENCY for a passing check and HTTP_STATUS_DOWN for a
+// failing one.
+func (h *hostHealth) record(result string, rise, fall int) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	old := h.state.Status
+	h.state.LastCheck = time.Now()
+	if result == HTTP_STATUS_DOWN {
+		h.state.Failures++
+		h.state.Successes = 0
+		if old == HTTP_STATUS_UNKNOWN || h.state.Failures >= fall {
+			h.state.Status = HTTP_STATUS_DOWN
+		}
+	} else {
+		h.state.Successes++
+		h.state.Failures = 0
+		if old != HTTP_STATUS_DOWN || h.state.Successes >= rise {
+			h.state.Status = result
+		}
+	}
+	return h.state.published()
+}
+
+func (h *hostHealth) snapshot() HealthState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.state
+}
+
+// Health returns the health check state of host.
+func (l *LoadBalancer) Health(host string) (HealthState, bool) {
+	b, ok := l.pool.Load().byAddress[host]
+	if !ok {
+		return HealthState{}, false
+	}
+	return b.health.snapshot(), true
+}
+
+// recordCheck feeds one health check result for host through its rise/fall
+// counters and publishes the resulting status in HostStatus. Ejected hosts
+// keep their HostStatus until the ejection expires, and forced ones keep the
+// forced status. A status event is sent only when HostStatus changes; reason
+// and latency describe the check for it.
+func (l *LoadBalancer) recordCheck(host, result string, latency time.Duration, reason string) {
+	b, ok := l.pool.Load().byAddress[host]
+	if !ok {
+		return
+	}
+	config := l.Config()
+	published := b.health.record(result, max(1, config.HealthyThreshold), max(1, config.UnhealthyThreshold))
+	current, _ := l.HostStatus.Load(host)
+	if current == HTTP_STATUS_EJECTED || current == published {
+		return
+	}
+	if l.HostStatus.CompareAndSwap(host, current, published) {
+		old, _ := current.(string)
+		l.publishStatus(host, old, published, reason, latency)
+	}
+}
+
+// ForceStatus pins host to HTTP_STATUS_HEALTHY, HTTP_STATUS_DOWN or
+// HTTP_STATUS_DRAINING whatever its health checks say, e.g. to take it out of
+// rotation for a deploy. Health checks keep running meanwhile. An empty status
+// hands the host back to its health checks.
+func (l *LoadBalancer) ForceStatus(host, status string) error {
+	if status != "" && status != HTTP_STATUS_HEALTHY && status != HTTP_STATUS_DOWN && status != HTTP_STATUS_DRAINING {
+		return errors.New("Unsupported forced status: " + status)
+	}
+	b, ok := l.pool.Load().byAddress[host]
+	if !ok {
+		return errUnknownBackend
+	}
+	b.health.mu.Lock()
+	b.health.state.Forced = status
+	b.health.state.ForcedAt = time.Now()
+	next := b.health.state.published()
+	b.health.mu.Unlock()
+
+	reason := "forced " + status
+	if status == "" {
+		reason = "returned to health checks"
+	}
+	value, _ := l.HostStatus.Swap(host, next)
+	if old, _ := value.(string); old != next {
+		l.publishStatus(host, old, next, reason, 0)
+	}
+	return nil
+}
+
+const (
+	HEALTH_CHECK_HTTP = "http"
+	HEALTH_CHECK_TCP  = "tcp"
+)
+
+const (
+	defaultHealthCheckConcurrency = 16
+	// healthCheckJitter spreads checks of each host by up to this fraction
+	// of the interval either way, so hosts are not all probed in lockstep.
+	healthCheckJitter = 0.1
+)
+
+// Checker probes a single backend. Check returns how long the backend took
+// to answer, or an error if the check failed. ctx carries HealthCheckTimeout
+// and is cancelled when health checks stop. The result is fed through the
+// same rise/fall state machine whatever the Checker. A Checker that holds
+// connections may also implement io.Closer; it is closed once a reload has
+// replaced it or health checks stop. One that keeps them per host may also
+// implement Forget(host string), which is called once a removed host is no
+// longer being checked.
+type Checker interface {
+	Check(ctx context.Context, host string) (time.Duration, error)
+}
+
+type hostForgetter interface {
+	Forget(host string)
+}
+
+// CheckerFactory builds a Checker for a config. It is called once per
+// LoadBalancer and again on every Reload, and may reject settings the check
+// cannot use.
+type CheckerFactory func(config *Config) (Checker, error)
+
+var checkers = map[string]CheckerFactory{
+	HEALTH_CHECK_HTTP: func(config *Config) (Checker, error) {
+		return newHTTPChecker(config)
+	},
+	HEALTH_CHECK_TCP: func(*Config) (Checker, error) {
+		return tcpChecker{}, nil
+	},
+	HEALTH_CHECK_GRPC: newGRPCChecker,
+}
+
+// RegisterChecker makes a custom health check selectable through
+// Config.HealthCheckType. It is not safe for concurrent use and is meant to
+// be called from init functions.
+func RegisterChecker(name string, factory CheckerFactory) {
+	checkers[name] = factory
+}
+
+func newChecker(config *Config) (Checker, error) {
+	name := config.HealthCheckType
+	if name == "" {
+		name = HEALTH_CHECK_HTTP
+		if config.Protocol == "rpc" {
+			name = HEALTH_CHECK_TCP
+		}
+	}
+	factory, ok := checkers[name]
+	if !ok {
+		return nil, errors.New("Unsupported HealthCheckType: " + name)
+	}
+	return factory(config)
+}
+
+// healthChecker runs one scheduler goroutine per backend. Each scheduler
+// checks its host, then waits HealthCheckInterval if the host passed or
+// HealthCheckDownInterval if it did not. At most HealthCheckConcurrency
+// checks run at once across all hosts.
+type healthChecker struct {
+	l       *LoadBalancer
+	slots   chan struct{}
+	mu      sync.Mutex
+	ctx     context.Context
+	running map[string]context.CancelCauseFunc
+	stopped bool
+	wg      sync.WaitGroup // one per scheduler
+}
+
+func newHealthChecker(l *LoadBalancer) *healthChecker {
+	concurrency := l.Config().HealthCheckConcurrency
+	if concurrency == 0 {
+		concurrency = defaultHealthCheckConcurrency
+	}
+	return &healthChecker{l: l, slots: make(chan struct{}, concurrency), running: map[string]context.CancelCauseFunc{}}
+}
+
+// StartHealthChecks starts checking every backend until ctx is cancelled or
+// Shutdown is called.
+func (l *LoadBalancer) StartHealthChecks(ctx context.Context) {
+	l.checks.mu.Lock()
+	if l.checks.stopped {
+		l.checks.mu.Unlock()
+		return
+	}
+	l.checks.ctx = ctx
+	l.checks.mu.Unlock()
+	l.checks.sync()
+}
+
+// errHostRemoved cancels the scheduler of a host that left the pool, so the
+// checker can forget it once the scheduler has exited.
+var errHostRemoved = errors.New("host removed")
+
+// stop cancels every scheduler for good, waits for them to exit and closes
+// the checker.
+func (h *healthChecker) stop() {
+	h.mu.Lock()
+	h.stopped = true
+	h.ctx = nil
+	for host, cancel := range h.running {
+		cancel(nil)
+		delete(h.running, host)
+	}
+	h.mu.Unlock()
+	h.wg.Wait()
+	if closer, ok := h.l.current().checker.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// restart replaces every scheduler, so a reload's settings apply to each host
+// at once rather than after its current wait. Checks cut short are not
+// recorded.
+func (h *healthChecker) restart() {
+	h.mu.Lock()
+	for host, cancel := range h.running {
+		cancel(nil)
+		delete(h.running, host)
+	}
+	h.mu.Unlock()
+	h.sync()
+}
+
+// sync starts schedulers for backends that lack one and stops those whose
+// backend is gone. It does nothing before StartHealthChecks or after
+// Shutdown.
+func (h *healthChecker) sync() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.ctx == nil {
+		return
+	}
+	pool := h.l.pool.Load()
+	for host, cancel := range h.running {
+		if _, ok := pool.byAddress[host]; !ok {
+			cancel(errHostRemoved)
+			delete(h.running, host)
+		}
+	}
+	for _, b := range pool.backends {
+		if _, ok := h.running[b.address]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancelCause(h.ctx)
+		h.running[b.address] = cancel
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			h.run(ctx, b)
+			if context.Cause(ctx) != errHostRemoved {
+				return
+			}
+			if forgetter, ok := h.l.current().checker.(hostForgetter); ok {
+				forgetter.Forget(b.address)
+			}
+		}()
+	}
+}
+
+func (h *healthChecker) run(ctx context.Context, b *backend) {
+	for {
+		h.check(ctx, b.address)
+		timings := h.l.Config().healthCheckTimings()
+		interval := timings.downInterval
+		if status := b.health.snapshot().Status; status == HTTP_STATUS_HEALTHY || status == HTTP_STATUS_HIGH_LATENCY {
+			interval = timings.interval
+		}
+		timer := time.NewTimer(jitter(interval))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// check runs one check against host and records the result.
+func (h *healthChecker) check(ctx context.Context, host string) {
+	select {
+	case h.slots <- struct{}{}:
+		defer func() { <-h.slots }()
+	case <-ctx.Done():
+		return
+	}
+	settings := h.l.current()
+	timings := settings.config.healthCheckTimings()
+	checkCtx, cancel := context.WithTimeout(ctx, timings.timeout)
+	defer cancel()
+	timedelta, err := settings.checker.Check(checkCtx, host)
+	if ctx.Err() != nil {
+		// Stopped mid-check; the failure says nothing about the host.
+		return
+	}
+	if err != nil {
+		log.Printf("Host %s failed health check: %s", host, err)
+		h.l.recordCheck(host, HTTP_STATUS_DOWN, 0, err.Error())
+		return
+	}
+	h.l.observeLatency(host, timedelta)
+	if threshold := timings.unhealthyThreshold; timedelta > threshold {
+		log.Printf("Host %s has high latency: %s", host, timedelta)
+		h.l.recordCheck(host, HTTP_STATUS_HIGH_LATENCY, timedelta, fmt.Sprintf("latency %s above %s", timedelta, threshold))
+		return
+	}
+	h.l.recordCheck(host, HTTP_STATUS_HEALTHY, timedelta, "health check passed")
+}
+
+// checkHost runs a single health check against host outside the schedule.
+func (l *LoadBalancer) checkHost(ctx context.Context, host string) {
+	l.checks.check(ctx, host)
+}
+
+func jitter(d time.Duration) time.Duration {
+	spread := int64(float64(d) * healthCheckJitter)
+	if spread <= 0 {
+		return d
+	}
+	return d - time.Duration(spread) + time.Duration(rand.Int63n(2*spread+1))
+}
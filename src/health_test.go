@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthThresholds(t *testing.T) {
+	host := "http://a.example"
+	statusOf := func(lb *LoadBalancer) any {
+		status, _ := lb.HostStatus.Load(host)
+		return status
+	}
+	newLB := func(t *testing.T) *LoadBalancer {
+		t.Helper()
+		lb, err := NewLoadBalancer(&Config{InitialAddresses: []string{host}, HealthyThreshold: 2, UnhealthyThreshold: 3})
+		if err != nil {
+			t.Fatalf("Failed to create LoadBalancer: %v", err)
+		}
+		return lb
+	}
+
+	t.Run("TestFirstResultApplies", func(t *testing.T) {
+		lb := newLB(t)
+		lb.recordCheck(host, HTTP_STATUS_DOWN, 0, "")
+		if status := statusOf(lb); status != HTTP_STATUS_DOWN {
+			t.Errorf("expected unchecked host to go down on first failure, got %v", status)
+		}
+		lb = newLB(t)
+		lb.recordCheck(host, HTTP_STATUS_HEALTHY, 0, "")
+		if status := statusOf(lb); status != HTTP_STATUS_HEALTHY {
+			t.Errorf("expected unchecked host to come up on first success, got %v", status)
+		}
+	})
+
+	t.Run("TestFall", func(t *testing.T) {
+		lb := newLB(t)
+		lb.recordCheck(host, HTTP_STATUS_HEALTHY, 0, "")
+		lb.recordCheck(host, HTTP_STATUS_DOWN, 0, "")
+		lb.recordCheck(host, HTTP_STATUS_DOWN, 0, "")
+		lb.recordCheck(host, HTTP_STATUS_HIGH_LATENCY, 0, "")
+		lb.recordCheck(host, HTTP_STATUS_DOWN, 0, "")
+		lb.recordCheck(host, HTTP_STATUS_DOWN, 0, "")
+		if status := statusOf(lb); status != HTTP_STATUS_HIGH_LATENCY {
+			t.Fatalf("expected host to stay up below UnhealthyThreshold, got %v", status)
+		}
+		lb.recordCheck(host, HTTP_STATUS_DOWN, 0, "")
+		if status := statusOf(lb); status != HTTP_STATUS_DOWN {
+			t.Fatalf("expected host down after 3 failures, got %v", status)
+		}
+		if health, _ := lb.Health(host); health.Failures != 3 || health.Successes != 0 {
+			t.Errorf("unexpected counters: %+v", health)
+		}
+	})
+
+	t.Run("TestRise", func(t *testing.T) {
+		lb := newLB(t)
+		lb.recordCheck(host, HTTP_STATUS_DOWN, 0, "")
+		lb.recordCheck(host, HTTP_STATUS_HEALTHY, 0, "")
+		if status := statusOf(lb); status != HTTP_STATUS_DOWN {
+			t.Fatalf("expected host to stay down below HealthyThreshold, got %v", status)
+		}
+		lb.recordCheck(host, HTTP_STATUS_HEALTHY, 0, "")
+		if status := statusOf(lb); status != HTTP_STATUS_HEALTHY {
+			t.Fatalf("expected host up after 2 successes, got %v", status)
+		}
+	})
+
+	t.Run("TestEjectedHostKeepsStatus", func(t *testing.T) {
+		lb := newLB(t)
+		lb.recordCheck(host, HTTP_STATUS_HEALTHY, 0, "")
+		lb.HostStatus.Store(host, HTTP_STATUS_EJECTED)
+		lb.recordCheck(host, HTTP_STATUS_DOWN, 0, "")
+		lb.recordCheck(host, HTTP_STATUS_DOWN, 0, "")
+		lb.recordCheck(host, HTTP_STATUS_DOWN, 0, "")
+		if status := statusOf(lb); status != HTTP_STATUS_EJECTED {
+			t.Errorf("health checks should not end an ejection, got %v", status)
+		}
+		if health, _ := lb.Health(host); health.Status != HTTP_STATUS_DOWN {
+			t.Errorf("expected health state to track checks while ejected, got %v", health.Status)
+		}
+	})
+}
+
+// scriptedChecker is a custom Checker whose result per host is set by the
+// test. It records how many checks ran and the most that ran at once.
+type scriptedChecker struct {
+	mu      sync.Mutex
+	fail    map[string]bool
+	delay   time.Duration
+	calls   map[string]int
+	running atomic.Int64
+	peak    atomic.Int64
+}
+
+func (c *scriptedChecker) Check(ctx context.Context, host string) (time.Duration, error) {
+	running := c.running.Add(1)
+	defer c.running.Add(-1)
+	for peak := c.peak.Load(); running > peak && !c.peak.CompareAndSwap(peak, running); peak = c.peak.Load() {
+	}
+	c.mu.Lock()
+	c.calls[host]++
+	fail := c.fail[host]
+	c.mu.Unlock()
+	select {
+	case <-time.After(c.delay):
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	if fail {
+		return 0, errors.New("scripted failure")
+	}
+	return time.Millisecond, nil
+}
+
+func (c *scriptedChecker) callsTo(host string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[host]
+}
+
+func TestHealthCheckEngine(t *testing.T) {
+	hosts := []string{"http://a.example", "http://b.example", "http://c.example", "http://d.example"}
+	start := func(t *testing.T, config *Config, fail map[string]bool, delay time.Duration) (*LoadBalancer, *scriptedChecker, context.CancelFunc) {
+		t.Helper()
+		checker := &scriptedChecker{fail: fail, delay: delay, calls: map[string]int{}}
+		RegisterChecker("scripted", func(*Config) (Checker, error) { return checker, nil })
+		config.InitialAddresses = hosts
+		config.HealthCheckType = "scripted"
+		config.HealthCheckUnhealthyThreshold = 1000
+		lb, err := NewLoadBalancer(config)
+		if err != nil {
+			t.Fatalf("Failed to create LoadBalancer: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		lb.StartHealthChecks(ctx)
+		t.Cleanup(cancel)
+		return lb, checker, cancel
+	}
+
+	t.Run("TestCustomCheckerSharesStateMachine", func(t *testing.T) {
+		lb, _, _ := start(t, &Config{HealthCheckInterval: 20, HealthCheckDownInterval: 20}, map[string]bool{hosts[0]: true}, 0)
+		time.Sleep(100 * time.Millisecond)
+		if status, _ := lb.HostStatus.Load(hosts[0]); status != HTTP_STATUS_DOWN {
+			t.Errorf("expected failing host down, got %v", status)
+		}
+		if status, _ := lb.HostStatus.Load(hosts[1]); status != HTTP_STATUS_HEALTHY {
+			t.Errorf("expected passing host healthy, got %v", status)
+		}
+	})
+
+	t.Run("TestDownHostsUseDownInterval", func(t *testing.T) {
+		_, checker, _ := start(t, &Config{HealthCheckInterval: 20, HealthCheckDownInterval: 1000}, map[string]bool{hosts[0]: true}, 0)
+		time.Sleep(200 * time.Millisecond)
+		if up, down := checker.callsTo(hosts[1]), checker.callsTo(hosts[0]); down != 1 || up < 5 {
+			t.Errorf("expected many checks of the up host and one of the down host, got %d and %d", up, down)
+		}
+	})
+
+	t.Run("TestBoundedConcurrency", func(t *testing.T) {
+		_, checker, _ := start(t, &Config{HealthCheckInterval: 10, HealthCheckDownInterval: 10, HealthCheckConcurrency: 2}, nil, 20*time.Millisecond)
+		time.Sleep(150 * time.Millisecond)
+		if peak := checker.peak.Load(); peak != 2 {
+			t.Errorf("expected at most 2 checks at once, got %d", peak)
+		}
+	})
+
+	t.Run("TestCancelStopsChecks", func(t *testing.T) {
+		lb, checker, cancel := start(t, &Config{HealthCheckInterval: 10, HealthCheckDownInterval: 10}, nil, 50*time.Millisecond)
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+		time.Sleep(100 * time.Millisecond)
+		calls := checker.callsTo(hosts[0])
+		time.Sleep(100 * time.Millisecond)
+		if after := checker.callsTo(hosts[0]); after != calls {
+			t.Errorf("checks kept running after cancel: %d then %d", calls, after)
+		}
+		if status, _ := lb.HostStatus.Load(hosts[0]); status != HTTP_STATUS_UNKNOWN {
+			t.Errorf("cancelled check should not be recorded, got %v", status)
+		}
+	})
+
+	t.Run("TestJitter", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			if d := jitter(time.Second); d < 900*time.Millisecond || d > 1100*time.Millisecond {
+				t.Fatalf("jitter out of range: %v", d)
+			}
+		}
+	})
+}
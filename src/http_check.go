@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// healthCheckMaxBody bounds how much of a health check response is read for
+// body and JSON assertions.
+const healthCheckMaxBody = 64 << 10
+
+// HTTPHealthCheck describes the request sent to HealthCheckPath on every
+// backend and what counts as a passing response. The zero value is a GET
+// expecting status 200.
+type HTTPHealthCheck struct {
+	Method         string            // default GET
+	Headers        map[string]string // extra request headers, "Host" overrides the Host header
+	Body           string            // optional request body
+	ExpectedStatus []string          // accepted statuses or ranges such as "200-399", default 200
+	BodyContains   string            // substring the response body must contain
+	BodyRegex      string            // regular expression the response body must match
+	JSONAssertions []JSONAssertion   // checks on fields of a JSON response body
+}
+
+// JSONAssertion checks one field of a JSON health check response.
+type JSONAssertion struct {
+	Path   string // dot-separated keys and array indices, e.g. "status" or "checks.0.ok"
+	Equals any    // expected value, nil only requires the field to exist
+}
+
+type statusRange struct {
+	low, high int
+}
+
+type jsonAssertion struct {
+	path []string
+	want any
+}
+
+// httpCheck is a compiled HTTPHealthCheck.
+type httpCheck struct {
+	method     string
+	headers    http.Header
+	host       string
+	body       string
+	statuses   []statusRange
+	contains   string
+	regex      *regexp.Regexp
+	assertions []jsonAssertion
+}
+
+func newHTTPCheck(spec HTTPHealthCheck) (*httpCheck, error) {
+	c := &httpCheck{method: spec.Method, headers: http.Header{}, body: spec.Body, contains: spec.BodyContains}
+	if c.method == "" {
+		c.method = http.MethodGet
+	}
+	for name, value := range spec.Headers {
+		if strings.EqualFold(name, "Host") {
+			c.host = value
+			continue
+		}
+		c.headers.Set(name, value)
+	}
+	for _, status := range spec.ExpectedStatus {
+		r, err := parseStatusRange(status)
+		if err != nil {
+			return nil, err
+		}
+		c.statuses = append(c.statuses, r)
+	}
+	if len(c.statuses) == 0 {
+		c.statuses = []statusRange{{http.StatusOK, http.StatusOK}}
+	}
+	if spec.BodyRegex != "" {
+		regex, err := regexp.Compile(spec.BodyRegex)
+		if err != nil {
+			return nil, errors.New("HealthCheck.BodyRegex is invalid: " + err.Error())
+		}
+		c.regex = regex
+	}
+	for _, a := range spec.JSONAssertions {
+		if a.Path == "" {
+			return nil, errors.New("HealthCheck.JSONAssertions path cannot be empty")
+		}
+		// Round-trip the expected value through JSON so it compares equal to
+		// what encoding/json produces for the response, whatever type the
+		// config reader gave us.
+		var want any
+		if a.Equals != nil {
+			encoded, err := json.Marshal(a.Equals)
+			if err != nil {
+				return nil, fmt.Errorf("HealthCheck.JSONAssertions value for %s is invalid: %w", a.Path, err)
+			}
+			json.Unmarshal(encoded, &want)
+		}
+		c.assertions = append(c.assertions, jsonAssertion{path: strings.Split(a.Path, "."), want: want})
+	}
+	return c, nil
+}
+
+// parseStatusRange parses "200" or "200-399".
+func parseStatusRange(s string) (statusRange, error) {
+	low, high, isRange := strings.Cut(s, "-")
+	if !isRange {
+		high = low
+	}
+	l, errLow := strconv.Atoi(strings.TrimSpace(low))
+	h, errHigh := strconv.Atoi(strings.TrimSpace(high))
+	if errLow != nil || errHigh != nil || l < 100 || h > 599 || l > h {
+		return statusRange{}, errors.New("HealthCheck.ExpectedStatus has invalid status or range " + s)
+	}
+	return statusRange{l, h}, nil
+}
+
+// newRequest builds the health check request for url.
+func (c *httpCheck) newRequest(url string) (*http.Request, error) {
+	var body io.Reader
+	if c.body != "" {
+		body = strings.NewReader(c.body)
+	}
+	req, err := http.NewRequest(c.method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range c.headers {
+		req.Header[name] = values
+	}
+	if c.host != "" {
+		req.Host = c.host
+	}
+	return req, nil
+}
+
+// verify checks res against the spec and closes its body. It returns nil if
+// the check passed.
+func (c *httpCheck) verify(res *http.Response) error {
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, healthCheckMaxBody))
+	if err != nil {
+		return fmt.Errorf("reading body: %w", err)
+	}
+	if !c.acceptsStatus(res.StatusCode) {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	if c.contains != "" && !bytes.Contains(body, []byte(c.contains)) {
+		return fmt.Errorf("body does not contain %q", c.contains)
+	}
+	if c.regex != nil && !c.regex.Match(body) {
+		return fmt.Errorf("body does not match %q", c.regex)
+	}
+	if len(c.assertions) == 0 {
+		return nil
+	}
+	var doc any
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return fmt.Errorf("body is not JSON: %w", err)
+	}
+	for _, a := range c.assertions {
+		got, ok := lookupJSON(doc, a.path)
+		if !ok {
+			return fmt.Errorf("JSON field %s is missing", strings.Join(a.path, "."))
+		}
+		if a.want != nil && !reflect.DeepEqual(got, a.want) {
+			return fmt.Errorf("JSON field %s is %v, want %v", strings.Join(a.path, "."), got, a.want)
+		}
+	}
+	return nil
+}
+
+func (c *httpCheck) acceptsStatus(status int) bool {
+	for _, r := range c.statuses {
+		if status >= r.low && status <= r.high {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupJSON walks path through objects and arrays decoded by encoding/json.
+func lookupJSON(doc any, path []string) (any, bool) {
+	for _, key := range path {
+		switch node := doc.(type) {
+		case map[string]any:
+			value, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			doc = value
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			doc = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// httpChecker is the default Checker for the http protocol: it sends the
+// HTTPHealthCheck request to host + HealthCheckPath.
+type httpChecker struct {
+	path    string
+	timeout time.Duration
+	spec    *httpCheck
+}
+
+func newHTTPChecker(config *Config) (*httpChecker, error) {
+	spec, err := newHTTPCheck(config.HealthCheck)
+	if err != nil {
+		return nil, err
+	}
+	return &httpChecker{
+		path:    config.HealthCheckPath,
+		timeout: config.healthCheckTimings().timeout,
+		spec:    spec,
+	}, nil
+}
+
+func (c *httpChecker) Check(ctx context.Context, host string) (time.Duration, error) {
+	res, timedelta, err := c.timeGet(ctx, host+c.path)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.spec.verify(res); err != nil {
+		return 0, err
+	}
+	return timedelta, nil
+}
+
+// timeGet sends the health check request to url and measures the time to the
+// first response byte. The caller must close the response body.
+func (c *httpChecker) timeGet(ctx context.Context, url string) (*http.Response, time.Duration, error) {
+	req, err := c.spec.newRequest(url)
+	if err != nil {
+		return nil, 0, err
+	}
+	var timedelta time.Duration
+	var start time.Time
+
+	trace := &httptrace.ClientTrace{
+		GotFirstResponseByte: func() {
+			timedelta = time.Since(start)
+		},
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
+	start = time.Now()
+	res, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		cancel()
+		return nil, timedelta, err
+	}
+	// The timeout also covers reading the body for assertions.
+	res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+	return res, timedelta, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPHealthCheck(t *testing.T) {
+	var seen *http.Request
+	var seenBody string
+	status := http.StatusOK
+	body := `{"status":"ok","checks":[{"name":"db","ok":true,"lag":3}]}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := io.ReadAll(r.Body)
+		seen, seenBody = r, string(payload)
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	defer server.Close()
+
+	check := func(t *testing.T, spec HTTPHealthCheck) any {
+		t.Helper()
+		config := &Config{
+			InitialAddresses:              []string{server.URL},
+			HealthCheckPath:               "/health",
+			HealthCheckTimeout:            500,
+			HealthCheckUnhealthyThreshold: 1000,
+			HealthCheck:                   spec,
+		}
+		lb, err := NewLoadBalancer(config)
+		if err != nil {
+			t.Fatalf("Failed to create LoadBalancer: %v", err)
+		}
+		lb.checkHost(context.Background(), server.URL)
+		result, _ := lb.HostStatus.Load(server.URL)
+		return result
+	}
+
+	t.Run("TestDefaultSpec", func(t *testing.T) {
+		if result := check(t, HTTPHealthCheck{}); result != HTTP_STATUS_HEALTHY {
+			t.Errorf("expected healthy, got %v", result)
+		}
+		if seen.Method != http.MethodGet || seen.URL.Path != "/health" {
+			t.Errorf("unexpected request %s %s", seen.Method, seen.URL.Path)
+		}
+	})
+
+	t.Run("TestRequest", func(t *testing.T) {
+		check(t, HTTPHealthCheck{
+			Method:  http.MethodPost,
+			Headers: map[string]string{"X-Probe": "glb", "Host": "app.internal"},
+			Body:    "ping",
+		})
+		if seen.Method != http.MethodPost || seenBody != "ping" {
+			t.Errorf("unexpected request %s with body %q", seen.Method, seenBody)
+		}
+		if seen.Header.Get("X-Probe") != "glb" || seen.Host != "app.internal" {
+			t.Errorf("headers not applied: X-Probe=%q Host=%q", seen.Header.Get("X-Probe"), seen.Host)
+		}
+	})
+
+	t.Run("TestExpectedStatus", func(t *testing.T) {
+		defer func() { status = http.StatusOK }()
+		status = http.StatusMovedPermanently
+		if result := check(t, HTTPHealthCheck{}); result != HTTP_STATUS_DOWN {
+			t.Errorf("expected 301 to fail the default spec, got %v", result)
+		}
+		if result := check(t, HTTPHealthCheck{ExpectedStatus: []string{"200-399"}}); result != HTTP_STATUS_HEALTHY {
+			t.Errorf("expected 301 to pass 200-399, got %v", result)
+		}
+		if result := check(t, HTTPHealthCheck{ExpectedStatus: []string{"200", "204"}}); result != HTTP_STATUS_DOWN {
+			t.Errorf("expected 301 to fail 200,204, got %v", result)
+		}
+	})
+
+	t.Run("TestBodyMatch", func(t *testing.T) {
+		cases := []struct {
+			spec HTTPHealthCheck
+			want string
+		}{
+			{HTTPHealthCheck{BodyContains: `"status":"ok"`}, HTTP_STATUS_HEALTHY},
+			{HTTPHealthCheck{BodyContains: "degraded"}, HTTP_STATUS_DOWN},
+			{HTTPHealthCheck{BodyRegex: `"lag":\d+`}, HTTP_STATUS_HEALTHY},
+			{HTTPHealthCheck{BodyRegex: `^OK$`}, HTTP_STATUS_DOWN},
+		}
+		for _, c := range cases {
+			if result := check(t, c.spec); result != c.want {
+				t.Errorf("%+v: expected %s, got %v", c.spec, c.want, result)
+			}
+		}
+	})
+
+	t.Run("TestJSONAssertions", func(t *testing.T) {
+		cases := []struct {
+			assertions []JSONAssertion
+			want       string
+		}{
+			{[]JSONAssertion{{Path: "status", Equals: "ok"}}, HTTP_STATUS_HEALTHY},
+			{[]JSONAssertion{{Path: "checks.0.ok", Equals: true}, {Path: "checks.0.lag", Equals: 3}}, HTTP_STATUS_HEALTHY},
+			{[]JSONAssertion{{Path: "checks.0.name"}}, HTTP_STATUS_HEALTHY},
+			{[]JSONAssertion{{Path: "status", Equals: "degraded"}}, HTTP_STATUS_DOWN},
+			{[]JSONAssertion{{Path: "checks.1.ok"}}, HTTP_STATUS_DOWN},
+			{[]JSONAssertion{{Path: "status.code"}}, HTTP_STATUS_DOWN},
+		}
+		for _, c := range cases {
+			if result := check(t, HTTPHealthCheck{JSONAssertions: c.assertions}); result != c.want {
+				t.Errorf("%+v: expected %s, got %v", c.assertions, c.want, result)
+			}
+		}
+	})
+
+	t.Run("TestClosesBody", func(t *testing.T) {
+		checker, err := newHTTPChecker(&Config{HealthCheckTimeout: 500})
+		if err != nil {
+			t.Fatalf("Failed to create checker: %v", err)
+		}
+		res, _, err := checker.timeGet(context.Background(), server.URL)
+		if err != nil {
+			t.Fatalf("timeGet returned an error: %v", err)
+		}
+		closed := &closeRecorder{ReadCloser: res.Body}
+		res.Body = closed
+		checker.spec.verify(res)
+		if !closed.closed {
+			t.Errorf("verify did not close the response body")
+		}
+	})
+
+	t.Run("TestBodyReadWithinTimeout", func(t *testing.T) {
+		slowBody := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+			io.WriteString(w, "ready")
+		}))
+		defer slowBody.Close()
+		lb, err := NewLoadBalancer(&Config{InitialAddresses: []string{slowBody.URL}, HealthCheckTimeout: 500, HealthCheckUnhealthyThreshold: 1000, HealthCheck: HTTPHealthCheck{BodyContains: "ready"}})
+		if err != nil {
+			t.Fatalf("Failed to create LoadBalancer: %v", err)
+		}
+		lb.checkHost(context.Background(), slowBody.URL)
+		if result, _ := lb.HostStatus.Load(slowBody.URL); result != HTTP_STATUS_HEALTHY {
+			t.Errorf("expected body sent after headers to be checked, got %v", result)
+		}
+	})
+
+	t.Run("TestInvalidSpec", func(t *testing.T) {
+		invalid := []HTTPHealthCheck{
+			{ExpectedStatus: []string{"abc"}},
+			{ExpectedStatus: []string{"399-200"}},
+			{ExpectedStatus: []string{"200-700"}},
+			{BodyRegex: "("},
+			{JSONAssertions: []JSONAssertion{{Equals: "ok"}}},
+		}
+		for _, spec := range invalid {
+			if _, err := newHTTPCheck(spec); err == nil {
+				t.Errorf("expected error for invalid spec: %+v", spec)
+			}
+		}
+	})
+}
+
+type closeRecorder struct {
+	io.ReadCloser
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return c.ReadCloser.Close()
+}
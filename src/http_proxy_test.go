@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -60,12 +63,14 @@ func TestLoadBalancer(t *testing.T) {
 		HealthCheckDownInterval:       5000,
 	}
 
-	t.Run("TestInitialHostCheck", func(t *testing.T) {
+	t.Run("TestStartHealthChecks", func(t *testing.T) {
 		lb, err := NewLoadBalancer(config)
 		if err != nil {
 			t.Fatalf("Failed to create LoadBalancer: %v", err)
 		}
-		lb.InitialHostCheck()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		lb.StartHealthChecks(ctx)
 		time.Sleep(100 * time.Millisecond)
 
 		for _, host := range config.InitialAddresses {
@@ -149,20 +154,164 @@ func TestLoadBalancer(t *testing.T) {
 		}
 
 		// Shutdown the server
-		lbServer := &http.Server{
-			Addr: "localhost:8080",
+		if err := lb.Shutdown(context.Background()); err != nil {
+			t.Errorf("Shutdown failed: %v", err)
+		}
+		if err := <-errCh; err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("TestProxyRecordsLatency", func(t *testing.T) {
+		lb, err := NewLoadBalancer(config)
+		if err != nil {
+			t.Fatalf("Failed to create LoadBalancer: %v", err)
+		}
+		for _, host := range config.InitialAddresses {
+			lb.HostStatus.Store(host, HTTP_STATUS_HEALTHY)
+		}
+		proxy := httptest.NewServer(lb.newProxyHandler())
+		defer proxy.Close()
+
+		for i := 0; i < len(config.InitialAddresses); i++ {
+			res, err := http.Get(proxy.URL + "/")
+			if err != nil {
+				t.Fatalf("Failed to send request to LoadBalancer: %v", err)
+			}
+			res.Body.Close()
+		}
+		for _, host := range config.InitialAddresses {
+			if latency := lb.latency(host); latency < 0 {
+				t.Errorf("Expected latency to be recorded for %s, got %v", host, latency)
+			}
+		}
+	})
+
+	t.Run("TestProxyTracksInFlight", func(t *testing.T) {
+		started := make(chan struct{})
+		unblock := make(chan struct{})
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-unblock
+			w.Write([]byte("done"))
+		}))
+		defer slow.Close()
+
+		lb, err := NewLoadBalancer(&Config{InitialAddresses: []string{slow.URL}, Algorithm: ALGORITHM_LEAST_CONN})
+		if err != nil {
+			t.Fatalf("Failed to create LoadBalancer: %v", err)
+		}
+		lb.HostStatus.Store(slow.URL, HTTP_STATUS_HEALTHY)
+		proxy := httptest.NewServer(lb.newProxyHandler())
+		defer proxy.Close()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			res, err := http.Get(proxy.URL + "/")
+			if err == nil {
+				io.ReadAll(res.Body)
+				res.Body.Close()
+			}
+		}()
+		<-started
+		if got := lb.InFlight(slow.URL); got != 1 {
+			t.Errorf("Expected 1 in-flight request, got %d", got)
+		}
+		close(unblock)
+		<-done
+		// The client can see the full body just before the handler returns.
+		for i := 0; i < 100 && lb.InFlight(slow.URL) != 0; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		if got := lb.InFlight(slow.URL); got != 0 {
+			t.Errorf("Expected 0 in-flight requests after completion, got %d", got)
+		}
+	})
+
+	t.Run("TestProxyReleasesAbortedResponse", func(t *testing.T) {
+		// The backend promises a longer body than it sends, then resets.
+		broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+		}))
+		defer broken.Close()
+
+		lb, err := NewLoadBalancer(&Config{InitialAddresses: []string{broken.URL}, Algorithm: ALGORITHM_LEAST_CONN})
+		if err != nil {
+			t.Fatalf("Failed to create LoadBalancer: %v", err)
+		}
+		lb.HostStatus.Store(broken.URL, HTTP_STATUS_HEALTHY)
+		proxy := httptest.NewServer(lb.newProxyHandler())
+		defer proxy.Close()
+		proxy.Config.ErrorLog = log.New(io.Discard, "", 0)
+
+		for i := 0; i < 3; i++ {
+			if res, err := http.Get(proxy.URL + "/"); err == nil {
+				io.ReadAll(res.Body)
+				res.Body.Close()
+			}
+		}
+		for i := 0; i < 100 && lb.InFlight(broken.URL) != 0; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		if got := lb.InFlight(broken.URL); got != 0 {
+			t.Errorf("Expected 0 in-flight requests after aborted responses, got %d", got)
+		}
+	})
+
+	t.Run("TestReleaseAfterReAdd", func(t *testing.T) {
+		started, release := make(chan struct{}), make(chan struct{})
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		}))
+		defer slow.Close()
+
+		lb, err := NewLoadBalancer(&Config{InitialAddresses: []string{slow.URL}, Protocol: "http"})
+		if err != nil {
+			t.Fatalf("Failed to create LoadBalancer: %v", err)
+		}
+		lb.HostStatus.Store(slow.URL, HTTP_STATUS_HEALTHY)
+		proxy := httptest.NewServer(lb.newProxyHandler())
+		defer proxy.Close()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if res, err := http.Get(proxy.URL + "/"); err == nil {
+				res.Body.Close()
+			}
+		}()
+		<-started
+		if err := lb.RemoveBackend(slow.URL); err != nil {
+			t.Fatalf("RemoveBackend failed: %v", err)
+		}
+		if err := lb.AddBackend(Backend{Address: slow.URL}); err != nil {
+			t.Fatalf("AddBackend failed: %v", err)
+		}
+		close(release)
+		<-done
+		for i := 0; i < 100 && lb.InFlight(slow.URL) != 0; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		if got := lb.InFlight(slow.URL); got != 0 {
+			t.Errorf("Expected the re-added backend to have 0 in-flight requests, got %d", got)
 		}
-		lbServer.Close()
 	})
 
-	t.Run("TestUpdateAliveHosts", func(t *testing.T) {
+	t.Run("TestCheckAliveHost", func(t *testing.T) {
 		lb, err := NewLoadBalancer(config)
 		if err != nil {
 			t.Fatalf("Failed to create LoadBalancer: %v", err)
 		}
 		lb.HostStatus.Store(config.InitialAddresses[0], HTTP_STATUS_HEALTHY)
-		lb.UpdateAliveHosts()
-		time.Sleep(100 * time.Millisecond)
+		lb.checkHost(context.Background(), config.InitialAddresses[0])
 
 		status, _ := lb.HostStatus.Load(config.InitialAddresses[0])
 		if status != HTTP_STATUS_HEALTHY && status != HTTP_STATUS_DOWN && status != HTTP_STATUS_HIGH_LATENCY {
@@ -170,14 +319,13 @@ func TestLoadBalancer(t *testing.T) {
 		}
 	})
 
-	t.Run("TestUpdateDownHosts", func(t *testing.T) {
+	t.Run("TestCheckDownHost", func(t *testing.T) {
 		lb, err := NewLoadBalancer(config)
 		if err != nil {
 			t.Fatalf("Failed to create LoadBalancer: %v", err)
 		}
 		lb.HostStatus.Store(config.InitialAddresses[0], HTTP_STATUS_DOWN)
-		lb.UpdateDownHosts()
-		time.Sleep(100 * time.Millisecond)
+		lb.checkHost(context.Background(), config.InitialAddresses[0])
 
 		status, _ := lb.HostStatus.Load(config.InitialAddresses[0])
 		if status != HTTP_STATUS_HEALTHY && status != HTTP_STATUS_DOWN && status != HTTP_STATUS_HIGH_LATENCY {
@@ -192,11 +340,11 @@ func TestLoadBalancer(t *testing.T) {
 		}))
 		defer server.Close()
 
-		lb, err := NewLoadBalancer(config)
+		checker, err := newHTTPChecker(config)
 		if err != nil {
-			t.Fatalf("Failed to create LoadBalancer: %v", err)
+			t.Fatalf("Failed to create checker: %v", err)
 		}
-		res, duration, err := lb.timeGet(server.URL)
+		res, duration, err := checker.timeGet(context.Background(), server.URL)
 
 		if err != nil {
 			t.Errorf("timeGet returned an error: %v", err)
@@ -217,11 +365,11 @@ func TestLoadBalancer(t *testing.T) {
 		defer server.Close()
 
 		config.HealthCheckTimeout = 500 // ms
-		lb, err := NewLoadBalancer(config)
+		checker, err := newHTTPChecker(config)
 		if err != nil {
-			t.Fatalf("Failed to create LoadBalancer: %v", err)
+			t.Fatalf("Failed to create checker: %v", err)
 		}
-		_, _, err = lb.timeGet(server.URL)
+		_, _, err = checker.timeGet(context.Background(), server.URL)
 
 		if err == nil {
 			t.Error("Expected timeout error, got nil")
@@ -282,13 +430,68 @@ func TestLoadBalancer(t *testing.T) {
 			{HealthCheckTimeout: -1},
 			{HealthCheckUnhealthyThreshold: -1},
 			{HealthCheckDownInterval: -1},
+			{HealthyThreshold: -1},
+			{UnhealthyThreshold: -1},
+			{HealthCheckType: "icmp"},
+			{HealthCheckConcurrency: -1},
+			{Backends: []Backend{{Address: "http://localhost:8081", Weight: -1}}},
+			{Backends: []Backend{{Weight: 1}}},
 		}
+		valid := func(config Config) Config {
+			config.InitialAddresses = append(config.InitialAddresses, "http://a.example")
+			config.Protocol = "http"
+			return config
+		}
+		invalidConfigs = append(invalidConfigs,
+			valid(Config{Port: 65536}),
+			valid(Config{Port: -1}),
+			valid(Config{HealthCheckTimeout: 10000}),
+			valid(Config{HealthCheckInterval: 1000, HealthCheckTimeout: 1000}),
+			valid(Config{HealthCheckUnhealthyThreshold: 2000}),
+			valid(Config{InitialAddresses: []string{"a.example:8080"}}),
+			valid(Config{Backends: []Backend{{Address: "http://b.example", Weight: maxWeight + 1}}}),
+			valid(Config{InitialAddresses: []string{"tcp://a.example:8080"}}),
+			valid(Config{InitialAddresses: []string{"http://a example"}}),
+			Config{InitialAddresses: []string{"ftp://a.example"}, Protocol: "rpc"},
+			Config{InitialAddresses: []string{"tcp://a.example"}, Protocol: "rpc"},
+			Config{Backends: []Backend{{Address: "http://a.example"}}, Protocol: "rpc"},
+		)
 
 		for _, cfg := range invalidConfigs {
 			if err := cfg.ValidateConfig(); err == nil {
 				t.Errorf("Expected error for invalid config: %+v", cfg)
 			}
 		}
+
+		// Timings left at 0 take their defaults.
+		for _, cfg := range []Config{
+			valid(Config{}),
+			valid(Config{HealthCheckTimeout: 5000}),
+			{InitialAddresses: []string{"tcp://a.example:9000", "https://b.example:443"}, Protocol: "rpc"},
+		} {
+			if err := cfg.ValidateConfig(); err != nil {
+				t.Errorf("Expected %+v to be valid, got %v", cfg, err)
+			}
+		}
+	})
+
+	t.Run("TestConfigValidationReportsAll", func(t *testing.T) {
+		cfg := Config{
+			Port:               70000,
+			InitialAddresses:   []string{"http://a.example", "a.example"},
+			Protocol:           "http",
+			HealthCheckTimeout: 20000,
+			HealthyThreshold:   -1,
+		}
+		err := cfg.ValidateConfig()
+		if err == nil {
+			t.Fatalf("Expected error for invalid config")
+		}
+		for _, want := range []string{"Port 70000", "Backend a.example", "HealthCheckTimeout 20s", "HealthyThreshold"} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("Expected error to mention %q, got:\n%v", want, err)
+			}
+		}
 	})
 }
 
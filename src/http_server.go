@@ -4,9 +4,11 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
-	"net/http/httptrace"
 	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,182 +17,114 @@ const (
 	HTTP_STATUS_HEALTHY      = "http_healthy"
 	HTTP_STATUS_HIGH_LATENCY = "http_high_latency"
 	HTTP_STATUS_DOWN         = "http_down"
+	// HTTP_STATUS_EJECTED hosts failed too many live requests in a row and
+	// sit out of rotation until their ejection expires.
+	HTTP_STATUS_EJECTED = "http_ejected"
+	// HTTP_STATUS_DRAINING hosts get no new requests but finish the ones they
+	// have, so they can be stopped once their in-flight count reaches zero.
+	HTTP_STATUS_DRAINING = "http_draining"
 )
 
-func (l *LoadBalancer) timeGet(url string) (*http.Response, time.Duration, error) {
-	req, _ := http.NewRequest("GET", url, nil)
-	var timedelta time.Duration
-	var start time.Time
-
-	trace := &httptrace.ClientTrace{
-		GotFirstResponseByte: func() {
-			timedelta = time.Since(start)
-		},
+func (l *LoadBalancer) ServeHTTP() error {
+	config := l.Config()
+	log.Printf("Starting HTTP server on %s:%d", config.Host, config.Port)
+	listener, err := net.Listen("tcp", config.Host+":"+fmt.Sprintf("%d", config.Port))
+	if err != nil {
+		return err
 	}
-	ctx, cancel := context.WithTimeout(req.Context(), time.Duration(l.Config.HealthCheckTimeout)*time.Millisecond)
-	defer cancel()
-
-	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
-	start = time.Now()
-	res, err := http.DefaultTransport.RoundTrip(req)
-	return res, timedelta, err
-}
-
-func (l *LoadBalancer) InitialHostCheck() {
-	//check if hosts are alive
-	for _, host := range l.Config.InitialAddresses {
-		go func(host string) {
-			//res, err := http.Get(host + l.Config.HealthCheckPath)
-			res, timedelta, err := l.timeGet(host + l.Config.HealthCheckPath)
-			if err != nil {
-				fmt.Printf("Error checking host %s: %s", host, err)
-				log.Printf("Error checking host %s: %s", host, err)
-				return
-			}
-			if res.StatusCode != 200 {
-				fmt.Printf("Host %s unable to intialize, status %d, body %s", host, res.StatusCode, res.Body)
-				log.Printf("Host %s unable to intialize, status %d, body %s", host, res.StatusCode, res.Body)
-				l.HostStatus.Store(host, HTTP_STATUS_DOWN)
-				return
-			}
-			if timedelta > time.Duration(l.Config.HealthCheckUnhealthyThreshold)*time.Millisecond {
-				fmt.Printf("Host %s has high latency: %s", host, timedelta)
-				log.Printf("Host %s has high latency: %s", host, timedelta)
-				l.HostStatus.Store(host, HTTP_STATUS_HIGH_LATENCY)
-				return
-			}
-			l.HostStatus.Store(host, HTTP_STATUS_HEALTHY)
-		}(host)
+	s := &http.Server{Handler: l.newProxyHandler()}
+	if !l.startServing(listener, s) {
+		return nil
 	}
-}
-
-func (l *LoadBalancer) UpdateAliveHosts() {
-	for _, host := range l.Config.InitialAddresses {
-		go func(host string) {
-			hostStatus, _ := l.HostStatus.Load(host)
-			if hostStatus == HTTP_STATUS_DOWN || hostStatus == HTTP_STATUS_UNKNOWN {
-				return
-			}
-			//check status
-			//res, err := http.Get(host + l.Config.HealthCheckPath)
-			res, timedelta, err := l.timeGet(host + l.Config.HealthCheckPath)
-			if err != nil {
-				log.Printf("Error checking host %s: %s", host, err)
-				l.HostStatus.Store(host, HTTP_STATUS_DOWN)
-				return
-			}
-			if res.StatusCode != 200 {
-				log.Printf("Host %s non 200 response, status %d, body %s", host, res.StatusCode, res.Body)
-				l.HostStatus.Store(host, HTTP_STATUS_DOWN)
-				return
-			}
-			if timedelta > time.Duration(l.Config.HealthCheckUnhealthyThreshold)*time.Millisecond {
-				log.Printf("Host %s has high latency: %s", host, timedelta)
-				l.HostStatus.Store(host, HTTP_STATUS_HIGH_LATENCY)
-				return
-			}
-			l.HostStatus.Store(host, HTTP_STATUS_HEALTHY)
-		}(host)
+	l.StartHealthChecks(context.Background())
+	if err := s.Serve(listener); err != http.ErrServerClosed {
+		return err
 	}
+	return nil
 }
 
-func (l *LoadBalancer) UpdateDownHosts() {
-	for _, host := range l.Config.InitialAddresses {
-		go func(host string) {
-			hostStatus, _ := l.HostStatus.Load(host)
-			if hostStatus != HTTP_STATUS_DOWN && hostStatus != HTTP_STATUS_UNKNOWN {
-				return
-			}
-			res, timedelta, err := l.timeGet(host + l.Config.HealthCheckPath)
-			if err != nil {
-				log.Printf("Error checking host %s: %s", host, err)
-				l.HostStatus.Store(host, HTTP_STATUS_DOWN)
-				return
-			}
-			if res.StatusCode != 200 {
-				log.Printf("Host %s non 200 response, status %d, body %s", host, res.StatusCode, res.Body)
-				l.HostStatus.Store(host, HTTP_STATUS_DOWN)
-				return
-			}
-			if timedelta > time.Duration(l.Config.HealthCheckUnhealthyThreshold)*time.Millisecond {
-				log.Printf("Host %s has high latency: %s", host, timedelta)
-				l.HostStatus.Store(host, HTTP_STATUS_HIGH_LATENCY)
-				return
-			}
-			l.HostStatus.Store(host, HTTP_STATUS_HEALTHY)
-		}(host)
-	}
+// proxyTarget records which backend a request was sent to and when, so the
+// response path can attribute latency and in-flight counts to it.
+type proxyTarget struct {
+	host     string
+	url      *url.URL
+	inFlight *atomic.Int64 // host's counter as acquired
+	start    time.Time
+	err      error
+	pinned   bool // chosen from the sticky session cookie
 }
 
-func (l *LoadBalancer) ServeHTTP() error {
-	log.Printf("Starting HTTP server on %s:%d", l.Config.Host, l.Config.Port)
-	//initial host scheck
-	l.InitialHostCheck()
-	// Schedule regular host checks for alive hosts
-	go func() {
-		ticker := time.NewTicker(time.Duration(l.Config.HealthCheckInterval) * time.Millisecond)
-		defer ticker.Stop()
-		for range ticker.C {
-			l.UpdateAliveHosts()
+type proxyTargetKey struct{}
+
+// newProxyHandler picks the backend for each request and counts it as
+// in-flight until the response has been fully copied to the client. When no
+// backend is available the request is answered with 503 without proxying.
+func (l *LoadBalancer) newProxyHandler() http.Handler {
+	rpx := l.newReverseProxy()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, url := l.stickyBackend(r)
+		pinned := url != nil
+		if !pinned {
+			host, url = l.nextBackend(r)
 		}
-	}()
-
-	// Schedule regular host checks for down hosts
-	go func() {
-		ticker := time.NewTicker(time.Duration(l.Config.HealthCheckDownInterval) * time.Millisecond)
-		defer ticker.Stop()
-		for range ticker.C {
-			l.UpdateDownHosts()
+		if url == nil {
+			l.writeProxyError(w, r, "", errNoHealthyHosts)
+			return
 		}
-	}()
+		target := &proxyTarget{host: host, url: url, inFlight: l.acquire(host), start: time.Now(), pinned: pinned}
+		// Deferred because ReverseProxy panics with http.ErrAbortHandler
+		// when the upstream fails mid-body. A retry may have moved target to
+		// another host, having already released the first one.
+		defer func() {
+			l.release(target.inFlight)
+			l.current().balancer.Done(target.host, time.Since(target.start), target.err)
+		}()
+		rpx.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyTargetKey{}, target)))
+	})
+}
 
-	//start http server
+func (l *LoadBalancer) newReverseProxy() *httputil.ReverseProxy {
 	//check https://stackoverflow.com/questions/23164547/golang-reverseproxy-not-working
 	rewrite := func(r *httputil.ProxyRequest) {
 		//fmt.Printf("rewriting request in %s ", r.In.URL)
 		r.SetXForwarded()
-		//fmt.Printf("rewriting request in %s ", r.In.URL)
-		url := l.getNextURL()
-		//fmt.Print("got url ")
-		if url == nil {
-			log.Printf("No healthy hosts available")
+		target, ok := r.In.Context().Value(proxyTargetKey{}).(*proxyTarget)
+		if !ok {
 			return
 		}
-		//fmt.Printf("new_url: %s ", string(url.Host))
-		//targetURL, err := url.Parse(l.Config.InitialAddresses[0]) // TODO: implement load balancing + do the parse in config parse
-		// if err != nil {
-		// 	log.Printf("Error parsing URL %s: %s", l.Config.InitialAddresses[0], err)
-		// 	return
-		// }
-		r.SetURL(url)
+		r.SetURL(target.url)
+		if cookie := l.Config().StickyCookie; cookie != "" {
+			stripCookie(r.Out, cookie)
+		}
 		//fmt.Printf("rewriting request out %s ", r.Out.URL)
 	}
 
-	// modify_response := func(r *http.Response) error {
-	// 	fmt.Printf("response %s ", r.Status)
-	// 	return nil
-	// }
+	modify_response := func(r *http.Response) error {
+		if target, ok := r.Request.Context().Value(proxyTargetKey{}).(*proxyTarget); ok {
+			l.observeLatency(target.host, time.Since(target.start))
+			if l.Config().StickyCookie != "" && !target.pinned {
+				r.Header.Add("Set-Cookie", l.stickyCookie(target.host).String())
+			}
+		}
+		return nil
+	}
 
 	error_handler := func(w http.ResponseWriter, r *http.Request, err error) {
-		fmt.Printf("eh error %s %s", err, r.Proto)
+		host := ""
+		if target, ok := r.Context().Value(proxyTargetKey{}).(*proxyTarget); ok {
+			target.err = err
+			host = target.host
+		}
+		l.writeProxyError(w, r, host, err)
 	}
 
-	// listener, err := net.Listen("tcp", l.Config.Host+":"+fmt.Sprintf("%d", l.Config.Port))
-	// if err != nil {
-	// 	return err
-	// }
-	// l.Config.Port = listener.Addr().(*net.TCPAddr).Port
-
-	rpx := &httputil.ReverseProxy{
-		Rewrite: rewrite,
-		//ModifyResponse: modify_response,
-		ErrorHandler: error_handler,
-	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = l.Config().UpstreamTimeout.Duration()
 
-	s := &http.Server{
-		Addr:    l.Config.Host + ":" + fmt.Sprintf("%d", l.Config.Port),
-		Handler: rpx,
+	return &httputil.ReverseProxy{
+		Rewrite:        rewrite,
+		Transport:      newRetryTransport(l, transport),
+		ModifyResponse: modify_response,
+		ErrorHandler:   error_handler,
 	}
-	//return s.Serve(listener)
-	return s.ListenAndServe()
 }
@@ -4,75 +4,428 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// latencyDecay is the weight of a new sample when it is below the current
+// estimate; samples above it replace the estimate outright (peak-EWMA).
+const latencyDecay = 0.3
+
 type LoadBalancer struct {
-	Config      *Config
-	HostStatus  *sync.Map
-	HostLatency *sync.Map
-	parsedURLs  *sync.Map
-	currentIdx  int
+	HostStatus   *sync.Map
+	HostLatency  *sync.Map
+	HostInFlight *sync.Map // host -> *atomic.Int64
+	pool         atomic.Pointer[backendPool]
+	poolMu       sync.Mutex // serialises changes to pool and settings
+	settings     atomic.Pointer[settings]
+	outliers     *outlierDetector
+	checks       *healthChecker
+	events       *eventBus
+	serving      servingState
+}
+
+// settings is everything built from a Config. Reload replaces it as a whole,
+// so a request never mixes a balancer and an error page format from two
+// different configs.
+type settings struct {
+	config        *Config
+	balancer      Balancer
+	stickyKey     []byte
+	errorPages    *errorPages
+	checker       Checker
+	retry         *retryRules
+	outlierPolicy OutlierDetection // with defaults filled in
+}
+
+// newSettings builds settings for config. previous is nil for the first
+// config; otherwise an unset StickySecret keeps its random key, so reloading
+// does not invalidate every sticky session.
+func newSettings(config *Config, previous *settings) (*settings, error) {
+	balancer, err := newBalancer(config)
+	if err != nil {
+		return nil, err
+	}
+	var stickyKey []byte
+	if previous != nil && config.StickySecret == "" && previous.config.StickySecret == "" {
+		stickyKey = previous.stickyKey
+	} else if stickyKey, err = newStickyKey(config.StickySecret); err != nil {
+		return nil, err
+	}
+	errorPages, err := newErrorPages(config.ErrorFormat, config.ErrorTemplates)
+	if err != nil {
+		return nil, err
+	}
+	checker, err := newChecker(config)
+	if err != nil {
+		return nil, err
+	}
+	return &settings{
+		config:        config,
+		balancer:      balancer,
+		stickyKey:     stickyKey,
+		errorPages:    errorPages,
+		checker:       checker,
+		retry:         newRetryRules(config.Retry),
+		outlierPolicy: newOutlierPolicy(config.OutlierDetection),
+	}, nil
+}
+
+// current returns the active settings.
+func (l *LoadBalancer) current() *settings {
+	return l.settings.Load()
+}
+
+// Config returns the active configuration. Callers must not modify it; use
+// Reload to change it.
+func (l *LoadBalancer) Config() *Config {
+	return l.current().config
+}
+
+// backendPool is an immutable snapshot of the configured backends. It is only
+// ever replaced as a whole, so the request path reads it without locking.
+type backendPool struct {
+	backends  []*backend
+	byAddress map[string]*backend
+	byToken   map[string][]stickyEntry // see lookupSticky
+}
+
+// newBackendPool indexes backends by address and by their sticky cookie
+// token under key.
+func newBackendPool(backends []*backend, key []byte) *backendPool {
+	pool := &backendPool{
+		backends:  backends,
+		byAddress: make(map[string]*backend, len(backends)),
+		byToken:   make(map[string][]stickyEntry, len(backends)),
+	}
+	for _, b := range backends {
+		pool.byAddress[b.address] = b
+		token := newStickyToken(key, b.address)
+		prefix := token[:stickyIndexPrefix]
+		pool.byToken[prefix] = append(pool.byToken[prefix], stickyEntry{token: token, backend: b})
+	}
+	return pool
+}
+
+type backend struct {
+	address  string
+	url      *url.URL
+	weight   int
+	inFlight *atomic.Int64
+	rrWeight *atomic.Int64 // see roundRobinBalancer
+	health   *hostHealth
+}
+
+// hostStatePool recycles the HostState slices handed to Balancer.Pick so
+// selection does not allocate per request.
+var hostStatePool = sync.Pool{
+	New: func() any {
+		states := make([]HostState, 0, 16)
+		return &states
+	},
 }
 
 func NewLoadBalancer(config *Config) (*LoadBalancer, error) {
 	status := sync.Map{}
 	latency := sync.Map{}
-	parsedURLs := sync.Map{}
-	for _, host := range config.InitialAddresses {
+	inFlight := sync.Map{}
+	var backends []*backend
+	for _, b := range config.AllBackends() {
+		host := b.Address
 		status.Store(host, HTTP_STATUS_UNKNOWN)
-		latency.Store(host, -1)
-		url, error := url.Parse(host)
-		if error != nil {
-			return nil, errors.New("Error parsing URL: " + error.Error())
+		latency.Store(host, time.Duration(-1))
+		entry, err := newBackend(b)
+		if err != nil {
+			return nil, err
 		}
-		print("Parsed URL: ", host, "uu", url)
-		parsedURLs.Store(host, url)
-	}
-	return &LoadBalancer{
-		Config:      config,
-		HostStatus:  &status,
-		HostLatency: &latency,
-		parsedURLs:  &parsedURLs,
-		currentIdx:  0,
-	}, nil
+		inFlight.Store(host, entry.inFlight)
+		backends = append(backends, entry)
+	}
+	settings, err := newSettings(config, nil)
+	if err != nil {
+		return nil, err
+	}
+	l := &LoadBalancer{
+		HostStatus:   &status,
+		HostLatency:  &latency,
+		HostInFlight: &inFlight,
+		events:       newEventBus(config.Notifications),
+	}
+	l.settings.Store(settings)
+	l.outliers = newOutlierDetector(l)
+	l.checks = newHealthChecker(l)
+	l.pool.Store(newBackendPool(backends, settings.stickyKey))
+	return l, nil
+}
+
+func newBackend(b Backend) (*backend, error) {
+	url, err := url.Parse(b.Address)
+	if err != nil {
+		return nil, errors.New("Error parsing URL: " + err.Error())
+	}
+	return &backend{address: b.Address, url: url, weight: b.Weight, inFlight: &atomic.Int64{}, rrWeight: &atomic.Int64{}, health: newHostHealth()}, nil
+}
+
+// backends returns the current backend snapshot. Callers must not modify it.
+func (l *LoadBalancer) backends() []*backend {
+	return l.pool.Load().backends
+}
+
+// parsedURL returns the parsed URL of host, or nil if it is not configured.
+func (l *LoadBalancer) parsedURL(host string) *url.URL {
+	b, ok := l.pool.Load().byAddress[host]
+	if !ok {
+		return nil
+	}
+	return b.url
 }
 
 func (l *LoadBalancer) getNextURL() *url.URL {
-	for s := 0; s < len(l.Config.InitialAddresses); s++ {
-		l.currentIdx = (l.currentIdx + 1) % len(l.Config.InitialAddresses)
-		// If all hosts are down, return nil
-		status, ok := l.HostStatus.Load(l.Config.InitialAddresses[l.currentIdx])
-		if !ok || status == HTTP_STATUS_DOWN {
-			continue
+	_, outUrl := l.nextBackend(nil)
+	return outUrl
+}
+
+// nextBackend asks the balancer for a host and returns its address along with
+// its parsed URL. r is nil for TCP connections.
+func (l *LoadBalancer) nextBackend(r *http.Request) (string, *url.URL) {
+	return l.nextBackendExcluding(r, nil)
+}
+
+// nextBackendExcluding is nextBackend with the hosts in exclude presented to
+// the balancer as down, e.g. because a retry must go elsewhere.
+func (l *LoadBalancer) nextBackendExcluding(r *http.Request, exclude []string) (string, *url.URL) {
+	pool := l.pool.Load()
+	statesPtr := hostStatePool.Get().(*[]HostState)
+	states := l.appendHostStates((*statesPtr)[:0], pool)
+	for i := range states {
+		for _, host := range exclude {
+			if states[i].Address == host {
+				states[i].Status = HTTP_STATUS_DOWN
+			}
 		}
-		//fmt.Print("Returning URL pt 1: ", l.Config.InitialAddresses[l.currentIdx], status)
-		outUrl, ok := l.parsedURLs.Load(l.Config.InitialAddresses[l.currentIdx])
-		//fmt.Print("Returning URL pt 1.5: ", ok)
+	}
+	host := l.current().balancer.Pick(r, states)
+	*statesPtr = states[:0]
+	hostStatePool.Put(statesPtr)
+
+	// If all hosts are down, return nil
+	if host == "" {
+		return "", nil
+	}
+	b, ok := pool.byAddress[host]
+	if !ok {
+		fmt.Print("Error loading URL")
+		return "", nil
+	}
+	return host, b.url
+}
+
+// appendHostStates appends the current state of every backend in pool.
+func (l *LoadBalancer) appendHostStates(states []HostState, pool *backendPool) []HostState {
+	for _, b := range pool.backends {
+		status, _ := l.HostStatus.Load(b.address)
+		statusString, _ := status.(string)
+		states = append(states, HostState{
+			Address:  b.address,
+			Weight:   b.weight,
+			Status:   statusString,
+			Latency:  l.latency(b.address),
+			InFlight: b.inFlight.Load(),
+			rrWeight: b.rrWeight,
+		})
+	}
+	return states
+}
+
+// InFlight returns the number of requests currently being proxied to host.
+func (l *LoadBalancer) InFlight(host string) int64 {
+	counter, ok := l.HostInFlight.Load(host)
+	if !ok {
+		return 0
+	}
+	return counter.(*atomic.Int64).Load()
+}
+
+// InFlightCounts returns a snapshot of in-flight requests for every host.
+func (l *LoadBalancer) InFlightCounts() map[string]int64 {
+	counts := map[string]int64{}
+	for _, b := range l.backends() {
+		counts[b.address] = b.inFlight.Load()
+	}
+	return counts
+}
+
+// acquire counts a request to host as in flight and returns the counter to
+// pass to release. The counter is resolved here rather than on release, so a
+// request that outlives its backend's removal never decrements the counter
+// of a backend added again under the same address.
+func (l *LoadBalancer) acquire(host string) *atomic.Int64 {
+	value, ok := l.HostInFlight.Load(host)
+	if !ok {
+		return nil
+	}
+	counter := value.(*atomic.Int64)
+	counter.Add(1)
+	return counter
+}
+
+func (l *LoadBalancer) release(counter *atomic.Int64) {
+	if counter != nil {
+		counter.Add(-1)
+	}
+}
+
+// latency returns the current latency estimate for host, or -1 if there is
+// none yet.
+func (l *LoadBalancer) latency(host string) time.Duration {
+	value, ok := l.HostLatency.Load(host)
+	if !ok {
+		return -1
+	}
+	return value.(time.Duration)
+}
+
+// observeLatency folds a new sample into the host's peak-EWMA estimate.
+func (l *LoadBalancer) observeLatency(host string, sample time.Duration) {
+	for {
+		old, ok := l.HostLatency.Load(host)
 		if !ok {
-			fmt.Print("Error loading URL")
-			return nil
+			return
+		}
+		current := old.(time.Duration)
+		next := sample
+		if current >= 0 && sample < current {
+			next = time.Duration(latencyDecay*float64(sample) + (1-latencyDecay)*float64(current))
+		}
+		if l.HostLatency.CompareAndSwap(host, old, next) {
+			return
+		}
+	}
+}
+
+var (
+	errUnknownBackend = errors.New("unknown backend")
+	errBackendExists  = errors.New("backend already exists")
+)
+
+// updatePool swaps in the backend list returned by change, which receives a
+// copy of the current one. Requests already routed keep using the old
+// snapshot; new ones see the change immediately.
+func (l *LoadBalancer) updatePool(change func(backends []*backend) ([]*backend, error)) error {
+	l.poolMu.Lock()
+	defer l.poolMu.Unlock()
+	backends, err := change(append([]*backend(nil), l.pool.Load().backends...))
+	if err != nil {
+		return err
+	}
+	// Reload stores its settings inside change, so this is the new key.
+	l.pool.Store(newBackendPool(backends, l.current().stickyKey))
+	return nil
+}
+
+// AddBackend starts sending traffic to a new backend once it passes a health
+// check. The address is checked as ValidateConfig checks those in the config.
+func (l *LoadBalancer) AddBackend(b Backend) error {
+	if err := validateBackendAddress(b.Address, l.Config().Protocol); err != nil {
+		return err
+	}
+	if err := validateWeight(b.Weight); err != nil {
+		return errors.New("Backend " + err.Error())
+	}
+	if b.Weight == 0 {
+		b.Weight = 1
+	}
+	entry, err := newBackend(b)
+	if err != nil {
+		return err
+	}
+	err = l.updatePool(func(backends []*backend) ([]*backend, error) {
+		for _, existing := range backends {
+			if existing.address == b.Address {
+				return nil, errBackendExists
+			}
 		}
-		//fmt.Print("Returning URL pt 2: ", outUrl)
-		return outUrl.(*url.URL)
+		// Unlike backends known at startup, which get traffic while their
+		// first check runs, one added to a live pool waits for it.
+		l.HostStatus.Store(b.Address, HTTP_STATUS_DOWN)
+		l.HostLatency.Store(b.Address, time.Duration(-1))
+		l.HostInFlight.Store(b.Address, entry.inFlight)
+		return append(backends, entry), nil
+	})
+	if err != nil {
+		return err
 	}
+	l.checks.sync()
 	return nil
 }
 
+// RemoveBackend stops sending new traffic to a backend and forgets it.
+// Requests already in flight to it are not interrupted.
+func (l *LoadBalancer) RemoveBackend(address string) error {
+	err := l.updatePool(func(backends []*backend) ([]*backend, error) {
+		for i, b := range backends {
+			if b.address == address {
+				return append(backends[:i], backends[i+1:]...), nil
+			}
+		}
+		return nil, errUnknownBackend
+	})
+	if err != nil {
+		return err
+	}
+	l.HostStatus.Delete(address)
+	l.HostLatency.Delete(address)
+	l.HostInFlight.Delete(address)
+	l.checks.sync()
+	return nil
+}
+
+// SetWeight changes a backend's share of traffic. A zero weight is treated
+// as 1.
+func (l *LoadBalancer) SetWeight(address string, weight int) error {
+	if err := validateWeight(weight); err != nil {
+		return errors.New("Backend " + err.Error())
+	}
+	if weight == 0 {
+		weight = 1
+	}
+	return l.updatePool(func(backends []*backend) ([]*backend, error) {
+		for i, b := range backends {
+			if b.address == address {
+				updated := *b
+				updated.weight = weight
+				backends[i] = &updated
+				return backends, nil
+			}
+		}
+		return nil, errUnknownBackend
+	})
+}
+
+// Serve runs the proxy, and the admin API if configured, until Shutdown is
+// called, and then returns nil.
 func (l *LoadBalancer) Serve() error {
-	if err := l.Config.ValidateConfig(); err != nil {
+	config := l.Config()
+	if err := config.ValidateConfig(); err != nil {
 		return err
 	}
-	switch l.Config.Protocol {
+	if config.AdminAddress != "" {
+		go func() {
+			if err := l.ServeAdmin(); err != nil {
+				log.Printf("Admin API stopped: %s", err)
+			}
+		}()
+	}
+	switch config.Protocol {
 	case "http":
-		l.ServeHTTP()
-		return nil
+		return l.ServeHTTP()
 	case "rpc":
-		l.ServeRPC()
-		return nil
+		return l.ServeRPC()
 	default:
-		log.Fatalf("Unsupported protocol: %s", l.Config.Protocol)
+		log.Fatalf("Unsupported protocol: %s", config.Protocol)
 		return errors.New("Unsupported protocol")
 	}
 }
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestLoadBalancer(t *testing.T, config *Config) *LoadBalancer {
+	t.Helper()
+	lb, err := NewLoadBalancer(config)
+	if err != nil {
+		t.Fatalf("Failed to create LoadBalancer: %v", err)
+	}
+	for _, b := range config.AllBackends() {
+		lb.HostStatus.Store(b.Address, HTTP_STATUS_HEALTHY)
+	}
+	return lb
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	config := &Config{
+		Backends: []Backend{
+			{Address: "http://a.example", Weight: 5},
+			{Address: "http://b.example", Weight: 1},
+			{Address: "http://c.example", Weight: 1},
+		},
+	}
+
+	t.Run("TestSmoothSequence", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, config)
+		expected := []string{"a", "a", "b", "a", "c", "a", "a"}
+		for round := 0; round < 3; round++ {
+			for i, want := range expected {
+				got := lb.getNextURL()
+				if got == nil || got.Host != want+".example" {
+					t.Fatalf("round %d pick %d: expected %s, got %v", round, i, want, got)
+				}
+			}
+		}
+	})
+
+	t.Run("TestConcurrentPicks", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, config)
+		const goroutines, picks = 100, 140
+		var mu sync.Mutex
+		counts := map[string]int{}
+		var wg sync.WaitGroup
+		for i := 0; i < goroutines; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < picks; j++ {
+					host := lb.getNextURL().Host
+					mu.Lock()
+					counts[host]++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		// Racing picks may reorder the sequence but not skew the split.
+		total := goroutines * picks
+		for host, weight := range map[string]int{"a.example": 5, "b.example": 1, "c.example": 1} {
+			if want := total * weight / 7; counts[host] < want-total/50 || counts[host] > want+total/50 {
+				t.Errorf("expected about %d picks of %s, got %v", want, host, counts)
+			}
+		}
+	})
+
+	t.Run("TestSkipsDownHosts", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, config)
+		lb.HostStatus.Store("http://a.example", HTTP_STATUS_DOWN)
+		counts := map[string]int{}
+		for i := 0; i < 10; i++ {
+			counts[lb.getNextURL().Host]++
+		}
+		if counts["a.example"] != 0 || counts["b.example"] != 5 || counts["c.example"] != 5 {
+			t.Errorf("unexpected distribution with a down: %v", counts)
+		}
+	})
+
+	t.Run("TestAllDown", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, config)
+		for _, b := range config.Backends {
+			lb.HostStatus.Store(b.Address, HTTP_STATUS_DOWN)
+		}
+		if got := lb.getNextURL(); got != nil {
+			t.Errorf("expected nil with all hosts down, got %v", got)
+		}
+	})
+
+	t.Run("TestInitialAddressesDefaultWeight", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, &Config{
+			InitialAddresses: []string{"http://a.example"},
+			Backends:         []Backend{{Address: "http://b.example"}},
+		})
+		counts := map[string]int{}
+		for i := 0; i < 10; i++ {
+			counts[lb.getNextURL().Host]++
+		}
+		if counts["a.example"] != 5 || counts["b.example"] != 5 {
+			t.Errorf("expected even split with default weights, got %v", counts)
+		}
+	})
+}
+
+func TestLeastLatency(t *testing.T) {
+	config := &Config{
+		InitialAddresses: []string{"http://fast.example", "http://slow.example"},
+		Algorithm:        ALGORITHM_LEAST_LATENCY,
+	}
+
+	t.Run("TestPrefersFastHost", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, config)
+		lb.observeLatency("http://fast.example", 10*time.Millisecond)
+		lb.observeLatency("http://slow.example", 100*time.Millisecond)
+		for i := 0; i < 5; i++ {
+			if got := lb.getNextURL(); got.Host != "fast.example" {
+				t.Fatalf("pick %d: expected fast.example, got %s", i, got.Host)
+			}
+		}
+	})
+
+	t.Run("TestHighLatencyIsSoftPenalty", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, config)
+		lb.observeLatency("http://fast.example", 10*time.Millisecond)
+		lb.observeLatency("http://slow.example", 30*time.Millisecond)
+		lb.HostStatus.Store("http://fast.example", HTTP_STATUS_HIGH_LATENCY)
+		if got := lb.getNextURL(); got.Host != "slow.example" {
+			t.Errorf("expected penalised host to lose, got %s", got.Host)
+		}
+		lb.HostStatus.Store("http://slow.example", HTTP_STATUS_DOWN)
+		if got := lb.getNextURL(); got == nil || got.Host != "fast.example" {
+			t.Errorf("expected high latency host to stay usable, got %v", got)
+		}
+	})
+
+	t.Run("TestPeakEWMA", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, config)
+		host := "http://fast.example"
+		if got := lb.latency(host); got != -1 {
+			t.Fatalf("expected unknown latency, got %v", got)
+		}
+		lb.observeLatency(host, 100*time.Millisecond)
+		lb.observeLatency(host, 10*time.Millisecond)
+		if got := lb.latency(host); got <= 10*time.Millisecond || got >= 100*time.Millisecond {
+			t.Errorf("expected decayed estimate between samples, got %v", got)
+		}
+		lb.observeLatency(host, 500*time.Millisecond)
+		if got := lb.latency(host); got != 500*time.Millisecond {
+			t.Errorf("expected peak to be taken immediately, got %v", got)
+		}
+	})
+}
+
+func TestLeastConn(t *testing.T) {
+	config := &Config{
+		Backends: []Backend{
+			{Address: "http://a.example", Weight: 2},
+			{Address: "http://b.example", Weight: 1},
+		},
+		Algorithm: ALGORITHM_LEAST_CONN,
+	}
+
+	t.Run("TestPrefersIdleHost", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, config)
+		lb.acquire("http://a.example")
+		lb.acquire("http://a.example")
+		lb.acquire("http://a.example")
+		if got := lb.getNextURL(); got.Host != "b.example" {
+			t.Errorf("expected b.example with fewer in-flight, got %s", got.Host)
+		}
+		if got := lb.InFlightCounts(); got["http://a.example"] != 3 || got["http://b.example"] != 0 {
+			t.Errorf("unexpected in-flight counts: %v", got)
+		}
+	})
+
+	t.Run("TestWeightedTieBreak", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, config)
+		counts := map[string]int{}
+		for i := 0; i < 9; i++ {
+			counts[lb.getNextURL().Host]++
+		}
+		if counts["a.example"] != 6 || counts["b.example"] != 3 {
+			t.Errorf("expected ties to follow weights, got %v", counts)
+		}
+	})
+
+	t.Run("TestReleaseOnCompletion", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, config)
+		lb.release(lb.acquire("http://b.example"))
+		if got := lb.InFlight("http://b.example"); got != 0 {
+			t.Errorf("expected 0 in-flight after release, got %d", got)
+		}
+	})
+}
+
+// recordingBalancer always picks the last available host and records
+// completions.
+type recordingBalancer struct {
+	mu   sync.Mutex
+	done []string
+}
+
+func (b *recordingBalancer) Pick(_ *http.Request, hosts []HostState) string {
+	for i := len(hosts) - 1; i >= 0; i-- {
+		if hosts[i].Available() {
+			return hosts[i].Address
+		}
+	}
+	return ""
+}
+
+func (b *recordingBalancer) Done(host string, _ time.Duration, _ error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.done = append(b.done, host)
+}
+
+func TestCustomBalancer(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	recorder := &recordingBalancer{}
+	RegisterBalancer("recording", func(*Config) (Balancer, error) { return recorder, nil })
+	defer delete(balancers, "recording")
+
+	config := &Config{
+		InitialAddresses: []string{"http://unused.example", backend.URL},
+		Protocol:         "http",
+		Algorithm:        "recording",
+	}
+	lb := newTestLoadBalancer(t, config)
+
+	proxy := httptest.NewServer(lb.newProxyHandler())
+	defer proxy.Close()
+	res, err := http.Get(proxy.URL + "/")
+	if err != nil {
+		t.Fatalf("Failed to send request to LoadBalancer: %v", err)
+	}
+	io.ReadAll(res.Body)
+	res.Body.Close()
+
+	for i := 0; i < 100; i++ {
+		recorder.mu.Lock()
+		n := len(recorder.done)
+		recorder.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if len(recorder.done) != 1 || recorder.done[0] != backend.URL {
+		t.Errorf("expected one completion for %s, got %v", backend.URL, recorder.done)
+	}
+
+	if _, err := NewLoadBalancer(&Config{InitialAddresses: []string{backend.URL}, Algorithm: "missing"}); err == nil {
+		t.Errorf("expected error for unregistered algorithm")
+	}
+}
+
+func TestPowerOfTwoChoices(t *testing.T) {
+	config := &Config{
+		InitialAddresses: []string{"http://a.example", "http://b.example", "http://c.example"},
+		Algorithm:        ALGORITHM_P2C,
+	}
+
+	t.Run("TestAvoidsBusyHost", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, config)
+		for i := 0; i < 10; i++ {
+			lb.acquire("http://a.example")
+		}
+		counts := map[string]int{}
+		for i := 0; i < 3000; i++ {
+			counts[lb.getNextURL().Host]++
+		}
+		// The two samples are distinct hosts, so a always loses.
+		if counts["a.example"] != 0 || counts["b.example"] < 1300 || counts["c.example"] < 1300 {
+			t.Errorf("expected busy host to be avoided, got %v", counts)
+		}
+
+		two := newTestLoadBalancer(t, &Config{InitialAddresses: []string{"http://a.example", "http://b.example"}, Algorithm: ALGORITHM_P2C})
+		two.acquire("http://a.example")
+		for i := 0; i < 100; i++ {
+			if got := two.getNextURL().Host; got != "b.example" {
+				t.Fatalf("expected the idle host of two to win every pick, got %s", got)
+			}
+		}
+	})
+
+	t.Run("TestLatencyTieBreak", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, &Config{InitialAddresses: []string{"http://fast.example", "http://slow.example"}, Algorithm: ALGORITHM_P2C})
+		lb.observeLatency("http://fast.example", time.Millisecond)
+		lb.observeLatency("http://slow.example", time.Second)
+		counts := map[string]int{}
+		for i := 0; i < 1000; i++ {
+			counts[lb.getNextURL().Host]++
+		}
+		if counts["fast.example"] != 1000 {
+			t.Errorf("expected lower latency to win ties, got %v", counts)
+		}
+	})
+
+	t.Run("TestSkipsDownHosts", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, config)
+		lb.HostStatus.Store("http://a.example", HTTP_STATUS_DOWN)
+		lb.HostStatus.Store("http://b.example", HTTP_STATUS_DOWN)
+		for i := 0; i < 20; i++ {
+			if got := lb.getNextURL(); got.Host != "c.example" {
+				t.Fatalf("expected only c.example, got %s", got.Host)
+			}
+		}
+		lb.HostStatus.Store("http://c.example", HTTP_STATUS_DOWN)
+		if got := lb.getNextURL(); got != nil {
+			t.Errorf("expected nil with all hosts down, got %v", got)
+		}
+	})
+}
+
+func TestConcurrentGetNextURL(t *testing.T) {
+	config := &Config{
+		InitialAddresses: []string{"http://a.example", "http://b.example", "http://c.example", "http://d.example"},
+	}
+	lb := newTestLoadBalancer(t, config)
+
+	const goroutines, picks = 200, 100
+	var mu sync.Mutex
+	counts := map[string]int{}
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			local := map[string]int{}
+			for j := 0; j < picks; j++ {
+				local[lb.getNextURL().Host]++
+			}
+			mu.Lock()
+			for host, n := range local {
+				counts[host] += n
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	want := goroutines * picks / len(config.InitialAddresses)
+	for _, host := range []string{"a.example", "b.example", "c.example", "d.example"} {
+		if counts[host] != want {
+			t.Errorf("expected exactly %d picks per host, got %v", want, counts)
+			break
+		}
+	}
+}
+
+func TestGetNextURLAllocations(t *testing.T) {
+	for _, algorithm := range []string{ALGORITHM_ROUND_ROBIN, ALGORITHM_LEAST_CONN, ALGORITHM_LEAST_LATENCY, ALGORITHM_P2C, ALGORITHM_CONSISTENT_HASH} {
+		t.Run(algorithm, func(t *testing.T) {
+			lb := newTestLoadBalancer(t, &Config{
+				InitialAddresses: []string{"http://a.example", "http://b.example", "http://c.example"},
+				Algorithm:        algorithm,
+				HashKey:          "header:X-User",
+			})
+			r, _ := http.NewRequest(http.MethodGet, "http://lb/", nil)
+			r.Header.Set("X-User", "alice")
+			lb.nextBackend(r)
+			if allocs := testing.AllocsPerRun(100, func() { lb.nextBackend(r) }); allocs != 0 {
+				t.Errorf("expected no allocations per pick, got %v", allocs)
+			}
+		})
+	}
+}
+
+// BenchmarkGetNextURLParallel measures selection throughput with hundreds of
+// goroutines contending on one LoadBalancer.
+func BenchmarkGetNextURLParallel(b *testing.B) {
+	config := &Config{
+		Backends: []Backend{
+			{Address: "http://a.example", Weight: 1},
+			{Address: "http://b.example", Weight: 1},
+			{Address: "http://c.example", Weight: 1},
+			{Address: "http://d.example", Weight: 1},
+		},
+	}
+	weighted := &Config{
+		Backends: []Backend{
+			{Address: "http://a.example", Weight: 4},
+			{Address: "http://b.example", Weight: 2},
+			{Address: "http://c.example", Weight: 1},
+			{Address: "http://d.example", Weight: 1},
+		},
+	}
+	cases := []struct {
+		name   string
+		config *Config
+		algo   string
+	}{
+		{"round_robin", config, ALGORITHM_ROUND_ROBIN},
+		{"weighted_round_robin", weighted, ALGORITHM_ROUND_ROBIN},
+		{"least_conn", config, ALGORITHM_LEAST_CONN},
+		{"least_latency", config, ALGORITHM_LEAST_LATENCY},
+		{"p2c", config, ALGORITHM_P2C},
+		{"consistent_hash", config, ALGORITHM_CONSISTENT_HASH},
+	}
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			cfg := *c.config
+			cfg.Algorithm = c.algo
+			lb, err := NewLoadBalancer(&cfg)
+			if err != nil {
+				b.Fatalf("Failed to create LoadBalancer: %v", err)
+			}
+			for _, backend := range cfg.Backends {
+				lb.HostStatus.Store(backend.Address, HTTP_STATUS_HEALTHY)
+			}
+			b.ReportAllocs()
+			b.SetParallelism(100)
+			b.RunParallel(func(pb *testing.PB) {
+				r, _ := http.NewRequest(http.MethodGet, "http://lb/", nil)
+				r.RemoteAddr = "10.0.0.1:1234"
+				for pb.Next() {
+					lb.nextBackend(r)
+				}
+			})
+		})
+	}
+}
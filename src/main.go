@@ -1,23 +1,139 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
+// commands are the subcommands of glb, each run with the arguments after
+// its name and returning the exit code. Without a subcommand glb serves, so
+// "glb -config file" keeps working.
+var commands = []struct {
+	name, summary string
+	run           func(args []string) int
+}{
+	{"serve", "run the load balancer (the default)", serve},
+	{"validate", "check a config file and report every problem in it", validate},
+}
+
 func main() {
-	configPath := flag.String("config", "", "path to the config file")
-	flag.Parse()
-	cfgReader := JsonConfigReader{Path: *configPath}
-	config, err := cfgReader.ReadConfig()
+	args := os.Args[1:]
+	run := serve
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		run = nil
+		for _, command := range commands {
+			if command.name == args[0] {
+				run = command.run
+			}
+		}
+		if run == nil {
+			if args[0] != "help" {
+				fmt.Fprintf(os.Stderr, "glb: unknown command %q\n\n", args[0])
+			}
+			usage()
+			os.Exit(2)
+		}
+		args = args[1:]
+	}
+	os.Exit(run(args))
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: glb [command] [flags]\n\nCommands:")
+	for _, command := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", command.name, command.summary)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun glb <command> -h for the flags of a command.")
+}
+
+func serve(args []string) int {
+	flags := flag.NewFlagSet("glb serve", flag.ExitOnError)
+	configPath := flags.String("config", "", "path to the config file, in JSON, YAML or TOML by its extension")
+	watch := flags.Bool("watch", false, "reload the config whenever the file changes, as well as on SIGHUP")
+	printOnly := flags.Bool("print-config", false, "print the effective config and where each value came from, then exit")
+	overrides := registerConfigFlags(flags)
+	flags.Parse(args)
+	loader := &ConfigLoader{Path: *configPath, Env: os.Environ(), Flags: overrides}
+	config, sources, err := loader.Load()
 	if err != nil {
-		log.Fatalf("Error reading config: %s", err)
-		return
+		log.Printf("Error reading config: %s", err)
+		return 1
+	}
+	if *printOnly {
+		if err := printConfig(os.Stdout, &config, sources); err != nil {
+			log.Printf("Error printing config: %s", err)
+			return 1
+		}
+		return 0
 	}
 	LoadBalancer, err := NewLoadBalancer(&config)
 	if err != nil {
-		log.Fatalf("Error creating load balancer: %s", err)
-		return
+		log.Printf("Error creating load balancer: %s", err)
+		return 1
+	}
+
+	signals, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	var changes <-chan struct{}
+	if *watch {
+		if *configPath == "" {
+			log.Printf("-watch needs -config")
+			return 2
+		}
+		if changes, err = watchConfig(signals, *configPath); err != nil {
+			log.Printf("Error watching config file: %s", err)
+			return 1
+		}
+	}
+	reload := func() {
+		config, _, err := loader.Load()
+		if err == nil {
+			err = LoadBalancer.Reload(&config)
+		}
+		if err != nil {
+			log.Printf("Rejected new config, keeping the current one: %s", err)
+			return
+		}
+		log.Printf("Reloaded config from %s", *configPath)
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- LoadBalancer.Serve() }()
+	for signals.Err() == nil {
+		select {
+		case err := <-served:
+			if err != nil {
+				log.Printf("Error serving: %s", err)
+				return 1
+			}
+			return 0
+		case <-hangups:
+			reload()
+		case <-changes:
+			reload()
+		case <-signals.Done():
+		}
+	}
+	// A second signal kills the process without waiting.
+	stop()
+
+	timeout := LoadBalancer.Config().ShutdownTimeout.or(defaultShutdownTimeout).Duration()
+	log.Printf("Shutting down, waiting up to %s for in-flight requests", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := LoadBalancer.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown did not finish cleanly: %s", err)
+		return 1
 	}
-	LoadBalancer.Serve()
+	<-served
+	log.Printf("Shut down")
+	return 0
 }
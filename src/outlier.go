@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultBaseEjectionTime   Milliseconds = 30000
+	defaultMaxEjectionTime    Milliseconds = 300000
+	defaultMaxEjectionPercent              = 10
+)
+
+// OutlierDetection ejects backends that keep failing live requests, even if
+// their health check endpoint still answers. Each ejection of the same host
+// lasts twice as long as the previous one, up to MaxEjectionTime.
+type OutlierDetection struct {
+	ConsecutiveFailures int          // 5xx responses or connection errors in a row before ejecting, 0 disables
+	BaseEjectionTime    Milliseconds // default 30s
+	MaxEjectionTime     Milliseconds // default 5m
+	MaxEjectionPercent  int          // share of hosts that may be ejected at once, default 10, at least one host
+}
+
+func (o *OutlierDetection) Validate() error {
+	if o.ConsecutiveFailures < 0 {
+		return errors.New("OutlierDetection.ConsecutiveFailures cannot be negative")
+	}
+	if o.BaseEjectionTime < 0 || o.MaxEjectionTime < 0 {
+		return errors.New("OutlierDetection ejection times cannot be negative")
+	}
+	if o.MaxEjectionTime > 0 && o.MaxEjectionTime < o.BaseEjectionTime {
+		return errors.New("OutlierDetection.MaxEjectionTime cannot be less than BaseEjectionTime")
+	}
+	if o.MaxEjectionPercent < 0 || o.MaxEjectionPercent > 100 {
+		return errors.New("OutlierDetection.MaxEjectionPercent must be between 0 and 100")
+	}
+	return nil
+}
+
+type outlierDetector struct {
+	l     *LoadBalancer
+	hosts sync.Map // host -> *outlierState
+	mu    sync.Mutex
+}
+
+type outlierState struct {
+	consecutive atomic.Int64
+	ejections   int       // guarded by outlierDetector.mu
+	restoredAt  time.Time // guarded by outlierDetector.mu
+}
+
+func newOutlierDetector(l *LoadBalancer) *outlierDetector {
+	return &outlierDetector{l: l}
+}
+
+// newOutlierPolicy fills in the defaults of config.
+func newOutlierPolicy(config OutlierDetection) OutlierDetection {
+	if config.BaseEjectionTime == 0 {
+		config.BaseEjectionTime = defaultBaseEjectionTime
+	}
+	if config.MaxEjectionTime == 0 {
+		config.MaxEjectionTime = max(defaultMaxEjectionTime, config.BaseEjectionTime)
+	}
+	if config.MaxEjectionPercent == 0 {
+		config.MaxEjectionPercent = defaultMaxEjectionPercent
+	}
+	return config
+}
+
+// isOutlierFailure reports whether an upstream result counts against the
+// backend. Requests the client abandoned do not.
+func isOutlierFailure(res *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	return res.StatusCode >= 500
+}
+
+// record feeds the result of one request to host into the detector.
+func (d *outlierDetector) record(host string, failed bool) {
+	policy := d.l.current().outlierPolicy
+	if policy.ConsecutiveFailures == 0 {
+		return
+	}
+	value, ok := d.hosts.Load(host)
+	if !ok {
+		value, _ = d.hosts.LoadOrStore(host, &outlierState{})
+	}
+	state := value.(*outlierState)
+	if !failed {
+		state.consecutive.Store(0)
+		return
+	}
+	if state.consecutive.Add(1) >= int64(policy.ConsecutiveFailures) {
+		d.eject(host, state, policy)
+	}
+}
+
+func (d *outlierDetector) eject(host string, state *outlierState, policy OutlierDetection) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	value, _ := d.l.HostStatus.Load(host)
+	current, _ := value.(string)
+	if current == HTTP_STATUS_EJECTED || current == HTTP_STATUS_DOWN || current == HTTP_STATUS_DRAINING {
+		return
+	}
+	backends := d.l.backends()
+	ejected := 0
+	for _, b := range backends {
+		if status, _ := d.l.HostStatus.Load(b.address); status == HTTP_STATUS_EJECTED {
+			ejected++
+		}
+	}
+	if allowed := max(1, len(backends)*policy.MaxEjectionPercent/100); ejected >= allowed {
+		log.Printf("Not ejecting host %s: %d of %d hosts already ejected", host, ejected, len(backends))
+		return
+	}
+
+	maxEjection := policy.MaxEjectionTime.Duration()
+	// A host that stayed in rotation for a full MaxEjectionTime starts over.
+	if !state.restoredAt.IsZero() && time.Since(state.restoredAt) > maxEjection {
+		state.ejections = 0
+	}
+	state.ejections++
+	state.consecutive.Store(0)
+	duration := policy.BaseEjectionTime.Duration()
+	for i := 1; i < state.ejections && duration < maxEjection; i++ {
+		duration *= 2
+	}
+	duration = min(duration, maxEjection)
+
+	log.Printf("Ejecting host %s for %s after %d consecutive failures", host, duration, policy.ConsecutiveFailures)
+	d.l.HostStatus.Store(host, HTTP_STATUS_EJECTED)
+	d.l.publishStatus(host, current, HTTP_STATUS_EJECTED, fmt.Sprintf("%d consecutive failed requests", policy.ConsecutiveFailures), 0)
+	time.AfterFunc(duration, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		// Health checks kept running while ejected, so return to whatever
+		// they last decided rather than the status before the ejection.
+		restored := current
+		if health, ok := d.l.Health(host); ok && health.published() != HTTP_STATUS_UNKNOWN {
+			restored = health.published()
+		}
+		if d.l.HostStatus.CompareAndSwap(host, HTTP_STATUS_EJECTED, restored) {
+			log.Printf("Host %s returned from ejection", host)
+			d.l.publishStatus(host, HTTP_STATUS_EJECTED, restored, "ejection expired", 0)
+		}
+		state.restoredAt = time.Now()
+	})
+}
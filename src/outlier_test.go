@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOutlierDetection(t *testing.T) {
+	config := &Config{
+		InitialAddresses: []string{"http://a.example", "http://b.example", "http://c.example"},
+		OutlierDetection: OutlierDetection{ConsecutiveFailures: 3, BaseEjectionTime: 100, MaxEjectionTime: 1000, MaxEjectionPercent: 34},
+	}
+	statusOf := func(lb *LoadBalancer, host string) any {
+		status, _ := lb.HostStatus.Load(host)
+		return status
+	}
+
+	t.Run("TestEjectsAfterConsecutiveFailures", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, config)
+		host := "http://a.example"
+		lb.outliers.record(host, true)
+		lb.outliers.record(host, true)
+		lb.outliers.record(host, false)
+		lb.outliers.record(host, true)
+		lb.outliers.record(host, true)
+		if status := statusOf(lb, host); status != HTTP_STATUS_HEALTHY {
+			t.Fatalf("success should reset the failure count, got %v", status)
+		}
+		lb.outliers.record(host, true)
+		if status := statusOf(lb, host); status != HTTP_STATUS_EJECTED {
+			t.Fatalf("expected host to be ejected, got %v", status)
+		}
+		for i := 0; i < 10; i++ {
+			if got := lb.getNextURL(); got.Host == "a.example" {
+				t.Fatalf("ejected host was picked")
+			}
+		}
+	})
+
+	t.Run("TestEjectionExpiresAndGrows", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, config)
+		host := "http://a.example"
+		eject := func() {
+			for i := 0; i < 3; i++ {
+				lb.outliers.record(host, true)
+			}
+		}
+		eject()
+		time.Sleep(150 * time.Millisecond)
+		if status := statusOf(lb, host); status != HTTP_STATUS_HEALTHY {
+			t.Fatalf("expected host restored after first ejection, got %v", status)
+		}
+		eject()
+		time.Sleep(150 * time.Millisecond)
+		if status := statusOf(lb, host); status != HTTP_STATUS_EJECTED {
+			t.Fatalf("expected second ejection to last longer, got %v", status)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if status := statusOf(lb, host); status != HTTP_STATUS_HEALTHY {
+			t.Fatalf("expected host restored after second ejection, got %v", status)
+		}
+	})
+
+	t.Run("TestMaxEjectionPercent", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, config)
+		for _, host := range config.InitialAddresses {
+			for i := 0; i < 3; i++ {
+				lb.outliers.record(host, true)
+			}
+		}
+		ejected := 0
+		for _, host := range config.InitialAddresses {
+			if statusOf(lb, host) == HTTP_STATUS_EJECTED {
+				ejected++
+			}
+		}
+		if ejected != 1 {
+			t.Errorf("expected only one of three hosts ejected at 34%%, got %d", ejected)
+		}
+	})
+
+	t.Run("TestHealthCheckDoesNotRevive", func(t *testing.T) {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer backend.Close()
+		lb := newTestLoadBalancer(t, &Config{InitialAddresses: []string{backend.URL}, HealthCheckTimeout: 500, HealthCheckUnhealthyThreshold: 200})
+		lb.HostStatus.Store(backend.URL, HTTP_STATUS_EJECTED)
+		lb.checkHost(context.Background(), backend.URL)
+		if status := statusOf(lb, backend.URL); status != HTTP_STATUS_EJECTED {
+			t.Errorf("health checks revived ejected host: %v", status)
+		}
+	})
+
+	t.Run("TestProxyFeedsDetector", func(t *testing.T) {
+		broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer broken.Close()
+		healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer healthy.Close()
+
+		lb := newTestLoadBalancer(t, &Config{
+			InitialAddresses: []string{broken.URL, healthy.URL},
+			OutlierDetection: OutlierDetection{ConsecutiveFailures: 2, MaxEjectionPercent: 50},
+		})
+		proxy := httptest.NewServer(lb.newProxyHandler())
+		defer proxy.Close()
+
+		for i := 0; i < 4; i++ {
+			res, err := http.Get(proxy.URL + "/")
+			if err != nil {
+				t.Fatalf("Failed to send request to LoadBalancer: %v", err)
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+		if status := statusOf(lb, broken.URL); status != HTTP_STATUS_EJECTED {
+			t.Errorf("expected backend returning 500s to be ejected, got %v", status)
+		}
+		for i := 0; i < 4; i++ {
+			res, err := http.Get(proxy.URL + "/")
+			if err != nil {
+				t.Fatalf("Failed to send request to LoadBalancer: %v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("expected traffic to avoid ejected host, got %d", res.StatusCode)
+			}
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	htmltemplate "html/template"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+const (
+	ERROR_FORMAT_TEXT = "text"
+	ERROR_FORMAT_JSON = "json"
+	ERROR_FORMAT_HTML = "html"
+)
+
+var errNoHealthyHosts = errors.New("no healthy hosts available")
+
+// ProxyError is the data available to ErrorTemplates.
+type ProxyError struct {
+	Status     int
+	StatusText string
+	Reason     string
+}
+
+// executor is the part of text/template and html/template used here.
+type executor interface {
+	Execute(w io.Writer, data any) error
+}
+
+var templateFuncs = map[string]any{
+	"json": func(v any) (string, error) {
+		out, err := json.Marshal(v)
+		return string(out), err
+	},
+}
+
+const (
+	defaultTextErrorTemplate = "{{.Status}} {{.StatusText}}: {{.Reason}}\n"
+	defaultHTMLErrorTemplate = "<!DOCTYPE html>\n<html><head><title>{{.Status}} {{.StatusText}}</title></head>" +
+		"<body><h1>{{.Status}} {{.StatusText}}</h1><p>{{.Reason}}</p></body></html>\n"
+	defaultJSONErrorTemplate = `{"status":{{.Status}},"error":{{json .StatusText}},"reason":{{json .Reason}}}` + "\n"
+)
+
+// errorPages renders the responses the load balancer itself sends when a
+// request cannot be proxied.
+type errorPages struct {
+	contentType string
+	fallback    executor
+	byStatus    map[int]executor
+}
+
+func newErrorPages(format string, templates map[int]string) (*errorPages, error) {
+	pages := &errorPages{byStatus: map[int]executor{}}
+	var parse func(name, text string) (executor, error)
+	switch format {
+	case "", ERROR_FORMAT_TEXT:
+		pages.contentType = "text/plain; charset=utf-8"
+		parse = parseTextTemplate
+		pages.fallback, _ = parse("default", defaultTextErrorTemplate)
+	case ERROR_FORMAT_JSON:
+		pages.contentType = "application/json"
+		parse = parseTextTemplate
+		pages.fallback, _ = parse("default", defaultJSONErrorTemplate)
+	case ERROR_FORMAT_HTML:
+		pages.contentType = "text/html; charset=utf-8"
+		parse = func(name, text string) (executor, error) {
+			return htmltemplate.New(name).Funcs(templateFuncs).Parse(text)
+		}
+		pages.fallback, _ = parse("default", defaultHTMLErrorTemplate)
+	default:
+		return nil, errors.New("Unsupported ErrorFormat: " + format)
+	}
+	for status, text := range templates {
+		if http.StatusText(status) == "" {
+			return nil, errors.New("ErrorTemplates has unknown status " + strconv.Itoa(status))
+		}
+		t, err := parse(strconv.Itoa(status), text)
+		if err != nil {
+			return nil, errors.New("Error parsing error template for " + strconv.Itoa(status) + ": " + err.Error())
+		}
+		pages.byStatus[status] = t
+	}
+	return pages, nil
+}
+
+func parseTextTemplate(name, text string) (executor, error) {
+	return template.New(name).Funcs(templateFuncs).Parse(text)
+}
+
+func (p *errorPages) render(data ProxyError) []byte {
+	var body bytes.Buffer
+	if t, ok := p.byStatus[data.Status]; ok {
+		if err := t.Execute(&body, data); err == nil {
+			return body.Bytes()
+		}
+		slog.Error("error template failed, using default", "status", data.Status)
+		body.Reset()
+	}
+	p.fallback.Execute(&body, data)
+	return body.Bytes()
+}
+
+// classifyProxyError maps a proxying failure onto the status returned to the
+// client and a short reason for logs and error pages.
+func classifyProxyError(err error) (int, string) {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errNoHealthyHosts):
+		return http.StatusServiceUnavailable, "no healthy hosts available"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout, "upstream timed out"
+	case errors.Is(err, context.Canceled):
+		return http.StatusBadGateway, "request canceled"
+	default:
+		return http.StatusBadGateway, "upstream connection failed"
+	}
+}
+
+// retryAfter is how long clients should wait after a 503: the next time a
+// down host is rechecked and could come back.
+func (l *LoadBalancer) retryAfter() int {
+	interval := l.Config().healthCheckTimings().downInterval
+	seconds := int((interval + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// writeProxyError answers a request the load balancer could not proxy. host
+// is the backend that failed, or empty if none was chosen.
+func (l *LoadBalancer) writeProxyError(w http.ResponseWriter, r *http.Request, host string, err error) {
+	status, reason := classifyProxyError(err)
+	slog.Warn("proxy error",
+		"status", status,
+		"reason", reason,
+		"host", host,
+		"method", r.Method,
+		"path", r.URL.Path,
+		"remote", r.RemoteAddr,
+		"error", err.Error(),
+	)
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", strconv.Itoa(l.retryAfter()))
+	}
+	pages := l.current().errorPages
+	w.Header().Set("Content-Type", pages.contentType)
+	w.WriteHeader(status)
+	w.Write(pages.render(ProxyError{Status: status, StatusText: http.StatusText(status), Reason: reason}))
+}
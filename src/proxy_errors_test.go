@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyErrors(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer slow.Close()
+
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedURL := "http://" + ln.Addr().String()
+	ln.Close()
+
+	get := func(t *testing.T, config *Config) (*http.Response, string) {
+		t.Helper()
+		lb := newTestLoadBalancer(t, config)
+		proxy := httptest.NewServer(lb.newProxyHandler())
+		defer proxy.Close()
+		res, err := http.Get(proxy.URL + "/")
+		if err != nil {
+			t.Fatalf("Failed to send request to LoadBalancer: %v", err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		return res, string(body)
+	}
+
+	t.Run("TestNoHealthyHosts", func(t *testing.T) {
+		config := &Config{InitialAddresses: []string{slow.URL}, HealthCheckDownInterval: 2500}
+		lb := newTestLoadBalancer(t, config)
+		lb.HostStatus.Store(slow.URL, HTTP_STATUS_DOWN)
+		proxy := httptest.NewServer(lb.newProxyHandler())
+		defer proxy.Close()
+
+		res, err := http.Get(proxy.URL + "/")
+		if err != nil {
+			t.Fatalf("Failed to send request to LoadBalancer: %v", err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("expected 503, got %d", res.StatusCode)
+		}
+		if got := res.Header.Get("Retry-After"); got != "3" {
+			t.Errorf("expected Retry-After 3, got %q", got)
+		}
+		if !strings.Contains(string(body), "no healthy hosts") {
+			t.Errorf("unexpected body: %q", body)
+		}
+	})
+
+	t.Run("TestConnectionRefused", func(t *testing.T) {
+		res, _ := get(t, &Config{InitialAddresses: []string{closedURL}})
+		if res.StatusCode != http.StatusBadGateway {
+			t.Errorf("expected 502, got %d", res.StatusCode)
+		}
+	})
+
+	t.Run("TestUpstreamTimeout", func(t *testing.T) {
+		res, _ := get(t, &Config{InitialAddresses: []string{slow.URL}, UpstreamTimeout: 50})
+		if res.StatusCode != http.StatusGatewayTimeout {
+			t.Errorf("expected 504, got %d", res.StatusCode)
+		}
+	})
+
+	t.Run("TestJSONFormat", func(t *testing.T) {
+		res, body := get(t, &Config{InitialAddresses: []string{closedURL}, ErrorFormat: ERROR_FORMAT_JSON})
+		if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("expected JSON content type, got %q", ct)
+		}
+		var parsed jsonErrorBody
+		if err := json.Unmarshal([]byte(body), &parsed); err != nil {
+			t.Fatalf("body is not JSON: %q", body)
+		}
+		if parsed.Status != http.StatusBadGateway || parsed.Error != "Bad Gateway" {
+			t.Errorf("unexpected JSON body: %+v", parsed)
+		}
+	})
+
+	t.Run("TestCustomTemplate", func(t *testing.T) {
+		res, body := get(t, &Config{
+			InitialAddresses: []string{closedURL},
+			ErrorFormat:      ERROR_FORMAT_HTML,
+			ErrorTemplates:   map[int]string{502: "<p>Oops {{.Status}}: {{.Reason}}</p>"},
+		})
+		if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+			t.Errorf("expected HTML content type, got %q", ct)
+		}
+		if body != "<p>Oops 502: upstream connection failed</p>" {
+			t.Errorf("unexpected body: %q", body)
+		}
+	})
+
+	t.Run("TestInvalidErrorConfig", func(t *testing.T) {
+		if _, err := newErrorPages("xml", nil); err == nil {
+			t.Errorf("expected unsupported format to be rejected")
+		}
+		if _, err := newErrorPages("", map[int]string{502: "{{.Broken"}); err == nil {
+			t.Errorf("expected broken template to be rejected")
+		}
+		if _, err := newErrorPages("", map[int]string{999: "x"}); err == nil {
+			t.Errorf("expected unknown status to be rejected")
+		}
+	})
+}
+
+type jsonErrorBody struct {
+	Status int
+	Error  string
+	Reason string
+}
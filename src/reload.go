@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// configDebounce is how long the config file must stay quiet before a change
+// is reported, since editors often save in several writes.
+const configDebounce = 200 * time.Millisecond
+
+// Reload switches to config without dropping connections. Backends, the
+// balancing algorithm, sticky sessions, error pages, retries, outlier
+// detection and health checks all follow the new config; backends kept from
+// the old one keep their health state, latency and in-flight count, and new
+// ones get traffic once they pass a health check. Requests already routed
+// finish as before.
+//
+// If config is invalid it is rejected and the current one stays active.
+// Settings that need a restart to change, such as the listen address, keep
+// their current values and a message is logged. Backends added through the
+// admin API are dropped unless the new config lists them.
+func (l *LoadBalancer) Reload(config *Config) error {
+	if err := config.ValidateConfig(); err != nil {
+		return err
+	}
+	next := *config
+	previous := l.current()
+	keepFixedSettings(&next, previous.config)
+	// e.g. dropping AdminToken is only valid with a loopback AdminAddress.
+	if err := next.ValidateConfig(); err != nil {
+		return err
+	}
+	settings, err := newSettings(&next, previous)
+	if err != nil {
+		return err
+	}
+	wanted := next.AllBackends()
+	entries := make([]*backend, len(wanted))
+	for i, b := range wanted {
+		if entries[i], err = newBackend(b); err != nil {
+			return err
+		}
+	}
+
+	var removed []string
+	err = l.updatePool(func(backends []*backend) ([]*backend, error) {
+		existing := make(map[string]*backend, len(backends))
+		for _, b := range backends {
+			existing[b.address] = b
+		}
+		kept := make(map[string]bool, len(entries))
+		for i, entry := range entries {
+			if old, ok := existing[entry.address]; ok {
+				updated := *old
+				updated.weight = entry.weight
+				entries[i] = &updated
+				kept[entry.address] = true
+				continue
+			}
+			// Kept out of rotation until its first check, as in AddBackend.
+			l.HostStatus.Store(entry.address, HTTP_STATUS_DOWN)
+			l.HostLatency.Store(entry.address, time.Duration(-1))
+			l.HostInFlight.Store(entry.address, entry.inFlight)
+		}
+		for address := range existing {
+			if !kept[address] {
+				removed = append(removed, address)
+			}
+		}
+		l.settings.Store(settings)
+		return entries, nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, address := range removed {
+		l.HostStatus.Delete(address)
+		l.HostLatency.Delete(address)
+		l.HostInFlight.Delete(address)
+	}
+	l.checks.restart()
+	if closer, ok := previous.checker.(io.Closer); ok {
+		closer.Close()
+	}
+	return nil
+}
+
+// keepFixedSettings copies from old the settings that cannot change while
+// running, logging each one config tried to change.
+func keepFixedSettings(config, old *Config) {
+	if config.Host != old.Host || config.Port != old.Port {
+		log.Printf("Listen address change to %s:%d needs a restart, keeping %s:%d", config.Host, config.Port, old.Host, old.Port)
+		config.Host, config.Port = old.Host, old.Port
+	}
+	if config.Protocol != old.Protocol {
+		log.Printf("Protocol change to %s needs a restart, keeping %s", config.Protocol, old.Protocol)
+		config.Protocol = old.Protocol
+	}
+	if config.AdminAddress != old.AdminAddress {
+		log.Printf("AdminAddress change to %q needs a restart, keeping %q", config.AdminAddress, old.AdminAddress)
+		config.AdminAddress = old.AdminAddress
+	}
+	if config.UpstreamTimeout != old.UpstreamTimeout {
+		log.Printf("UpstreamTimeout change needs a restart, keeping %s", old.UpstreamTimeout.Duration())
+		config.UpstreamTimeout = old.UpstreamTimeout
+	}
+	if config.HealthCheckConcurrency != old.HealthCheckConcurrency {
+		log.Printf("HealthCheckConcurrency change needs a restart, keeping %d", old.HealthCheckConcurrency)
+		config.HealthCheckConcurrency = old.HealthCheckConcurrency
+	}
+	if !reflect.DeepEqual(config.Notifications, old.Notifications) {
+		log.Printf("Notifications change needs a restart, keeping the current ones")
+		config.Notifications = old.Notifications
+	}
+}
+
+// watchConfig signals on the returned channel whenever the file at path
+// changes, until ctx is done. It watches the directory rather than the file
+// so editors that save by replacing the file are still noticed.
+func watchConfig(ctx context.Context, path string) (<-chan struct{}, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	target := filepath.Clean(path)
+	changed := make(chan struct{}, 1)
+	go func() {
+		defer watcher.Close()
+		var settled <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == target && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					settled = time.After(configDebounce)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Error watching config file: %s", err)
+			case <-settled:
+				settled = nil
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changed, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	a, b := "http://a.example", "http://b.example"
+	valid := func(config Config) *Config {
+		config.Protocol = "http"
+		config.HealthCheckInterval = 1000
+		config.HealthCheckTimeout = 500
+		config.HealthCheckUnhealthyThreshold = 200
+		config.HealthCheckDownInterval = 1000
+		return &config
+	}
+	picks := func(lb *LoadBalancer, n int) map[string]int {
+		counts := map[string]int{}
+		for i := 0; i < n; i++ {
+			if u := lb.getNextURL(); u != nil {
+				counts[u.String()]++
+			}
+		}
+		return counts
+	}
+
+	t.Run("TestKeepsHealthState", func(t *testing.T) {
+		added := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer added.Close()
+		lb := newTestLoadBalancer(t, valid(Config{InitialAddresses: []string{a, b}}))
+		lb.recordCheck(b, HTTP_STATUS_HEALTHY, 0, "")
+		lb.HostLatency.Store(b, 3*time.Millisecond)
+		lb.acquire(b)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		lb.StartHealthChecks(ctx)
+
+		err := lb.Reload(valid(Config{
+			Backends:  []Backend{{Address: b, Weight: 3}, {Address: added.URL}},
+			Algorithm: ALGORITHM_LEAST_CONN,
+			Retry:     RetryPolicy{MaxAttempts: 2},
+		}))
+		if err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+		if _, ok := lb.HostStatus.Load(a); ok {
+			t.Errorf("removed backend left in HostStatus")
+		}
+		if health, _ := lb.Health(b); health.Successes != 1 {
+			t.Errorf("expected kept backend to keep its health state, got %+v", health)
+		}
+		if lb.InFlight(b) != 1 || lb.latency(b) != 3*time.Millisecond {
+			t.Errorf("expected kept backend to keep in-flight count and latency, got %d and %s", lb.InFlight(b), lb.latency(b))
+		}
+		if weight := lb.pool.Load().byAddress[b].weight; weight != 3 {
+			t.Errorf("expected new weight 3, got %d", weight)
+		}
+		if lb.Config().Algorithm != ALGORITHM_LEAST_CONN || lb.current().retry.MaxAttempts != 2 {
+			t.Errorf("expected the new algorithm and retry policy, got %q and %d attempts", lb.Config().Algorithm, lb.current().retry.MaxAttempts)
+		}
+		for i := 0; i < 100 && picks(lb, 1)[added.URL] == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		// least_conn prefers the added backend, since b still has a request
+		// in flight.
+		if got := picks(lb, 4)[added.URL]; got != 4 {
+			t.Errorf("expected the added backend to be checked and picked, got %d of 4", got)
+		}
+	})
+
+	t.Run("TestRejectsInvalidConfig", func(t *testing.T) {
+		config := valid(Config{InitialAddresses: []string{a, b}})
+		lb := newTestLoadBalancer(t, config)
+		invalid := []*Config{
+			valid(Config{}),
+			valid(Config{InitialAddresses: []string{a}, Algorithm: "fastest"}),
+			{InitialAddresses: []string{a}, Protocol: "http", HealthCheckTimeout: 15000},
+		}
+		for _, c := range invalid {
+			if err := lb.Reload(c); err == nil {
+				t.Errorf("expected error for invalid config: %+v", c)
+			}
+		}
+		if lb.Config() != config {
+			t.Errorf("expected the old config to stay active")
+		}
+		if counts := picks(lb, 4); counts[a] != 2 || counts[b] != 2 {
+			t.Errorf("expected the old backends to stay in rotation, got %v", counts)
+		}
+	})
+
+	t.Run("TestFixedSettings", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, valid(Config{Host: "127.0.0.1", Port: 8000, InitialAddresses: []string{a}, AdminAddress: "127.0.0.1:9090"}))
+		if err := lb.Reload(valid(Config{Host: "127.0.0.1", Port: 9000, InitialAddresses: []string{a}, AdminAddress: "127.0.0.1:9090", HealthyThreshold: 2})); err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+		if config := lb.Config(); config.Port != 8000 || config.HealthyThreshold != 2 {
+			t.Errorf("expected the port kept and the threshold changed, got %d and %d", config.Port, config.HealthyThreshold)
+		}
+		// Keeping the old AdminAddress must not let the token be dropped
+		// from a non-loopback one.
+		lb = newTestLoadBalancer(t, valid(Config{InitialAddresses: []string{a}, AdminAddress: ":9090", AdminToken: "s3cret"}))
+		if err := lb.Reload(valid(Config{InitialAddresses: []string{a}, AdminAddress: "127.0.0.1:9090"})); err == nil {
+			t.Errorf("expected reload without AdminToken to be rejected")
+		}
+	})
+
+	t.Run("TestKeepsStickyKey", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, valid(Config{InitialAddresses: []string{a}, StickyCookie: "glb"}))
+		token := lb.stickyToken(a)
+		if err := lb.Reload(valid(Config{InitialAddresses: []string{a, b}, StickyCookie: "glb"})); err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+		if lb.stickyToken(a) != token {
+			t.Errorf("expected sticky sessions to survive a reload")
+		}
+		if got := lb.pool.Load().lookupSticky(lb.stickyToken(b)); got == nil || got.address != b {
+			t.Errorf("expected the added backend's token to be indexed, got %v", got)
+		}
+	})
+
+	t.Run("TestReindexesStickyTokens", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, valid(Config{InitialAddresses: []string{a}, StickyCookie: "glb", StickySecret: "old"}))
+		old := lb.stickyToken(a)
+		if err := lb.Reload(valid(Config{InitialAddresses: []string{a}, StickyCookie: "glb", StickySecret: "new"})); err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+		pool := lb.pool.Load()
+		if got := pool.lookupSticky(old); got != nil {
+			t.Errorf("expected the old secret's token to be rejected, got %s", got.address)
+		}
+		if got := pool.lookupSticky(lb.stickyToken(a)); got == nil || got.address != a {
+			t.Errorf("expected the new secret's token to resolve to %s, got %v", a, got)
+		}
+	})
+
+	t.Run("TestWatchConfig", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.json")
+		os.WriteFile(path, []byte("{}"), 0o644)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		changes, err := watchConfig(ctx, path)
+		if err != nil {
+			t.Fatalf("Failed to watch config: %v", err)
+		}
+		os.WriteFile(filepath.Join(filepath.Dir(path), "other.json"), []byte("{}"), 0o644)
+		select {
+		case <-changes:
+			t.Errorf("change to another file reported")
+		case <-time.After(2 * configDebounce):
+		}
+
+		// Editors often save by writing a new file and renaming it over.
+		replacement := path + ".tmp"
+		os.WriteFile(replacement, []byte(`{"Port": 1}`), 0o644)
+		os.Rename(replacement, path)
+		select {
+		case <-changes:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("change not reported")
+		}
+	})
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Retryable error classes for RetryPolicy.RetryableErrors.
+const (
+	RETRY_ON_CONNECT = "connect" // the backend could not be reached
+	RETRY_ON_RESET   = "reset"   // the connection was reset or closed mid-request
+	RETRY_ON_TIMEOUT = "timeout" // PerTryTimeout or UpstreamTimeout expired
+)
+
+const defaultRetryMaxBodyBytes = 64 << 10
+
+// retryBudgetCap bounds how many retries the budget can save up while
+// traffic is healthy, in retries.
+const retryBudgetCap = 10
+
+// RetryPolicy controls re-sending failed requests to another backend. Only
+// idempotent methods are retried.
+type RetryPolicy struct {
+	MaxAttempts       int          // total attempts including the first, 0 or 1 disables retries
+	RetryableStatuses []int        // upstream statuses that trigger a retry, default 502 and 503
+	RetryableErrors   []string     // connect, reset and/or timeout, default connect and reset
+	PerTryTimeout     Milliseconds // per attempt, 0 disables
+	BudgetPercent     float64      // retries allowed as a percentage of requests, 0 is unlimited
+	MaxBodyBytes      int64        // request bodies up to this size are buffered for replay, default 64KiB
+}
+
+func (p *RetryPolicy) Validate() error {
+	if p.MaxAttempts < 0 {
+		return errors.New("Retry.MaxAttempts cannot be negative")
+	}
+	for _, status := range p.RetryableStatuses {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("Retry.RetryableStatuses has invalid status %d", status)
+		}
+	}
+	for _, class := range p.RetryableErrors {
+		if class != RETRY_ON_CONNECT && class != RETRY_ON_RESET && class != RETRY_ON_TIMEOUT {
+			return errors.New("Retry.RetryableErrors has unsupported error class " + class)
+		}
+	}
+	if p.PerTryTimeout < 0 {
+		return errors.New("Retry.PerTryTimeout cannot be negative")
+	}
+	if p.BudgetPercent < 0 || p.BudgetPercent > 100 {
+		return errors.New("Retry.BudgetPercent must be between 0 and 100")
+	}
+	if p.MaxBodyBytes < 0 {
+		return errors.New("Retry.MaxBodyBytes cannot be negative")
+	}
+	return nil
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retryTransport sends each proxied request, re-picking a backend through
+// the balancer for every retry. Hosts already tried are hidden from the
+// balancer so a retry never lands on the backend that just failed.
+type retryTransport struct {
+	l    *LoadBalancer
+	next http.RoundTripper
+	// budget is in thousandths of a retry; every request deposits
+	// BudgetPercent*10 and every retry withdraws 1000.
+	budget atomic.Int64
+}
+
+// retryRules is a RetryPolicy with its defaults filled in and its retryable
+// statuses and error classes indexed.
+type retryRules struct {
+	RetryPolicy
+	statuses map[int]bool
+	errors   map[string]bool
+}
+
+func newRetryRules(policy RetryPolicy) *retryRules {
+	if policy.MaxBodyBytes == 0 {
+		policy.MaxBodyBytes = defaultRetryMaxBodyBytes
+	}
+	if policy.RetryableStatuses == nil {
+		policy.RetryableStatuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable}
+	}
+	if policy.RetryableErrors == nil {
+		policy.RetryableErrors = []string{RETRY_ON_CONNECT, RETRY_ON_RESET}
+	}
+	rules := &retryRules{RetryPolicy: policy, statuses: map[int]bool{}, errors: map[string]bool{}}
+	for _, status := range policy.RetryableStatuses {
+		rules.statuses[status] = true
+	}
+	for _, class := range policy.RetryableErrors {
+		rules.errors[class] = true
+	}
+	return rules
+}
+
+func newRetryTransport(l *LoadBalancer, next http.RoundTripper) *retryTransport {
+	t := &retryTransport{l: l, next: next}
+	t.budget.Store(retryBudgetCap * 1000)
+	return t
+}
+
+// policy returns the active retry rules.
+func (t *retryTransport) policy() *retryRules {
+	return t.l.current().retry
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target, _ := req.Context().Value(proxyTargetKey{}).(*proxyTarget)
+	retryable := target != nil && t.policy().MaxAttempts > 1 && isIdempotent(req.Method) && t.bufferBody(req)
+	if retryable {
+		t.deposit()
+	}
+
+	tried := []string{}
+	for attempt := 1; ; attempt++ {
+		res, err := t.try(req)
+		if target != nil {
+			t.l.outliers.record(target.host, isOutlierFailure(res, err))
+		}
+		if !retryable || attempt >= t.policy().MaxAttempts || !t.shouldRetry(req, res, err) {
+			return res, err
+		}
+		tried = append(tried, target.host)
+		host, url := t.l.nextBackendExcluding(req, tried)
+		if url == nil || !t.withdraw() {
+			return res, err
+		}
+		if err == nil {
+			err = fmt.Errorf("upstream returned %d", res.StatusCode)
+			io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+			res.Body.Close()
+		}
+		log.Printf("Retrying %s %s on %s after attempt %d on %s failed: %s", req.Method, req.URL.Path, host, attempt, target.host, err)
+
+		t.l.release(target.inFlight)
+		t.l.current().balancer.Done(target.host, time.Since(target.start), err)
+		previous := target.url
+		target.host, target.url, target.inFlight, target.start, target.pinned = host, url, t.l.acquire(host), time.Now(), false
+
+		req = retarget(req, previous, url)
+		if req.GetBody != nil {
+			req.Body, _ = req.GetBody()
+		}
+	}
+}
+
+// try runs a single attempt, bounded by PerTryTimeout if set.
+func (t *retryTransport) try(req *http.Request) (*http.Response, error) {
+	if t.policy().PerTryTimeout <= 0 {
+		return t.next.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.policy().PerTryTimeout.Duration())
+	res, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+func (t *retryTransport) shouldRetry(req *http.Request, res *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		// The client went away; there is nobody to retry for.
+		return false
+	}
+	if err == nil {
+		return t.policy().statuses[res.StatusCode]
+	}
+	return t.policy().errors[retryErrorClass(err)]
+}
+
+// bufferBody makes the request body replayable. It returns false if the body
+// is larger than MaxBodyBytes, in which case the request is sent once with
+// its body intact.
+func (t *retryTransport) bufferBody(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return true
+	}
+	if req.ContentLength > t.policy().MaxBodyBytes {
+		return false
+	}
+	prefix, err := io.ReadAll(io.LimitReader(req.Body, t.policy().MaxBodyBytes+1))
+	if err != nil || int64(len(prefix)) > t.policy().MaxBodyBytes {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(prefix), req.Body), req.Body}
+		return false
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(prefix))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(prefix)), nil
+	}
+	return true
+}
+
+func (t *retryTransport) deposit() {
+	if t.policy().BudgetPercent == 0 {
+		return
+	}
+	if t.budget.Add(int64(t.policy().BudgetPercent*10)) > retryBudgetCap*1000 {
+		t.budget.Store(retryBudgetCap * 1000)
+	}
+}
+
+func (t *retryTransport) withdraw() bool {
+	if t.policy().BudgetPercent == 0 {
+		return true
+	}
+	for {
+		balance := t.budget.Load()
+		if balance < 1000 {
+			return false
+		}
+		if t.budget.CompareAndSwap(balance, balance-1000) {
+			return true
+		}
+	}
+}
+
+// retryErrorClass maps a transport error onto a RetryableErrors class, or ""
+// if it is not one we know how to retry.
+func retryErrorClass(err error) string {
+	var netErr net.Error
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return RETRY_ON_TIMEOUT
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return RETRY_ON_CONNECT
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return RETRY_ON_RESET
+	}
+	return ""
+}
+
+// retarget returns a copy of req aimed at to instead of from, keeping the
+// part of the path that came from the client.
+func retarget(req *http.Request, from, to *url.URL) *http.Request {
+	out := req.Clone(req.Context())
+	out.URL.Scheme = to.Scheme
+	out.URL.Host = to.Host
+	out.URL.Path = strings.TrimSuffix(to.Path, "/") + "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, strings.TrimSuffix(from.Path, "/")), "/")
+	out.URL.RawPath = ""
+	out.Host = ""
+	return out
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
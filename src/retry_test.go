@@ -0,0 +1,184 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetries(t *testing.T) {
+	var failingHits atomic.Int64
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failingHits.Add(1)
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	resetting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer resetting.Close()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(500 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte("ok:" + r.URL.Path + ":" + string(body)))
+	}))
+	defer echo.Close()
+
+	send := func(t *testing.T, proxyURL, method, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, proxyURL+"/items", strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send request to LoadBalancer: %v", err)
+		}
+		out, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		return res.StatusCode, string(out)
+	}
+	start := func(t *testing.T, policy RetryPolicy, hosts ...string) string {
+		t.Helper()
+		lb := newTestLoadBalancer(t, &Config{InitialAddresses: hosts, Retry: policy})
+		proxy := httptest.NewServer(lb.newProxyHandler())
+		t.Cleanup(proxy.Close)
+		return proxy.URL
+	}
+
+	t.Run("TestRetriesStatusOnOtherHost", func(t *testing.T) {
+		proxy := start(t, RetryPolicy{MaxAttempts: 2}, failing.URL, echo.URL)
+		for i := 0; i < 6; i++ {
+			if status, body := send(t, proxy, http.MethodGet, ""); status != http.StatusOK || body != "ok:/items:" {
+				t.Fatalf("request %d: expected retried success, got %d %q", i, status, body)
+			}
+		}
+	})
+
+	t.Run("TestRetryReleasesInFlight", func(t *testing.T) {
+		lb := newTestLoadBalancer(t, &Config{InitialAddresses: []string{failing.URL, echo.URL}, Retry: RetryPolicy{MaxAttempts: 2}})
+		proxy := httptest.NewServer(lb.newProxyHandler())
+		defer proxy.Close()
+		for i := 0; i < 4; i++ {
+			send(t, proxy.URL, http.MethodGet, "")
+		}
+		// The client can see the full body just before the handler returns.
+		for i := 0; i < 100 && (lb.InFlight(failing.URL) != 0 || lb.InFlight(echo.URL) != 0); i++ {
+			time.Sleep(time.Millisecond)
+		}
+		if got := lb.InFlightCounts(); got[failing.URL] != 0 || got[echo.URL] != 0 {
+			t.Errorf("expected no requests left in flight after retries, got %v", got)
+		}
+	})
+
+	t.Run("TestRetriesConnectionReset", func(t *testing.T) {
+		proxy := start(t, RetryPolicy{MaxAttempts: 2}, resetting.URL, echo.URL)
+		for i := 0; i < 4; i++ {
+			if status, _ := send(t, proxy, http.MethodGet, ""); status != http.StatusOK {
+				t.Fatalf("request %d: expected retried success, got %d", i, status)
+			}
+		}
+	})
+
+	t.Run("TestDisabledByDefault", func(t *testing.T) {
+		proxy := start(t, RetryPolicy{}, resetting.URL)
+		if status, _ := send(t, proxy, http.MethodGet, ""); status != http.StatusBadGateway {
+			t.Errorf("expected 502 without retries, got %d", status)
+		}
+	})
+
+	t.Run("TestReplaysBody", func(t *testing.T) {
+		proxy := start(t, RetryPolicy{MaxAttempts: 2}, failing.URL, echo.URL)
+		for i := 0; i < 4; i++ {
+			if status, body := send(t, proxy, http.MethodPut, "payload"); status != http.StatusOK || body != "ok:/items:payload" {
+				t.Fatalf("request %d: expected body to be replayed, got %d %q", i, status, body)
+			}
+		}
+	})
+
+	t.Run("TestNonIdempotentNotRetried", func(t *testing.T) {
+		proxy := start(t, RetryPolicy{MaxAttempts: 2}, failing.URL, echo.URL)
+		failures := 0
+		for i := 0; i < 4; i++ {
+			if status, _ := send(t, proxy, http.MethodPost, "payload"); status == http.StatusServiceUnavailable {
+				failures++
+			}
+		}
+		if failures != 2 {
+			t.Errorf("expected POSTs to failing host to pass through, got %d failures", failures)
+		}
+	})
+
+	t.Run("TestLargeBodyNotRetried", func(t *testing.T) {
+		proxy := start(t, RetryPolicy{MaxAttempts: 2, MaxBodyBytes: 4}, failing.URL, echo.URL)
+		failures := 0
+		for i := 0; i < 4; i++ {
+			status, body := send(t, proxy, http.MethodPut, "too large")
+			if status == http.StatusServiceUnavailable {
+				failures++
+			} else if body != "ok:/items:too large" {
+				t.Errorf("large body was not forwarded intact: %q", body)
+			}
+		}
+		if failures != 2 {
+			t.Errorf("expected large bodies not to be retried, got %d failures", failures)
+		}
+	})
+
+	t.Run("TestPerTryTimeout", func(t *testing.T) {
+		proxy := start(t, RetryPolicy{MaxAttempts: 2, PerTryTimeout: 100, RetryableErrors: []string{RETRY_ON_TIMEOUT}}, slow.URL, echo.URL)
+		for i := 0; i < 2; i++ {
+			began := time.Now()
+			if status, _ := send(t, proxy, http.MethodGet, ""); status != http.StatusOK {
+				t.Fatalf("request %d: expected retried success, got %d", i, status)
+			}
+			if elapsed := time.Since(began); elapsed > 400*time.Millisecond {
+				t.Errorf("request %d: per-try timeout not applied, took %v", i, elapsed)
+			}
+		}
+	})
+
+	t.Run("TestRetryBudget", func(t *testing.T) {
+		failingHits.Store(0)
+		proxy := start(t, RetryPolicy{MaxAttempts: 2, BudgetPercent: 1}, failing.URL, echo.URL)
+		failures := 0
+		for i := 0; i < 40; i++ {
+			if status, _ := send(t, proxy, http.MethodGet, ""); status != http.StatusOK {
+				failures++
+			}
+		}
+		// The budget starts with retryBudgetCap retries and 40 requests at
+		// 1% add less than one more.
+		if hits := int(failingHits.Load()); hits <= retryBudgetCap || failures != hits-retryBudgetCap {
+			t.Errorf("expected exactly %d retries, got %d failing hits and %d failures", retryBudgetCap, hits, failures)
+		}
+	})
+
+	t.Run("TestInvalidPolicy", func(t *testing.T) {
+		invalid := []RetryPolicy{
+			{MaxAttempts: -1},
+			{RetryableStatuses: []int{42}},
+			{RetryableErrors: []string{"dns"}},
+			{PerTryTimeout: -1},
+			{BudgetPercent: 150},
+			{MaxBodyBytes: -1},
+		}
+		for _, policy := range invalid {
+			if err := policy.Validate(); err == nil {
+				t.Errorf("expected error for invalid policy: %+v", policy)
+			}
+		}
+	})
+}
@@ -1,7 +1,119 @@
 package main
 
-import "log"
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
 
-func (l *LoadBalancer) ServeRPC() {
-	log.Fatalf("RPC server not implemented")
+// Backends in "rpc" mode are plain TCP endpoints, given as "tcp://host:port"
+// in InitialAddresses or Backends so they parse the same way HTTP backends do.
+const tcpDialTimeout = 5 * time.Second
+
+// tcpChecker is the default Checker for the rpc protocol: a host passes if
+// a TCP connection to it can be opened.
+type tcpChecker struct{}
+
+func (tcpChecker) Check(ctx context.Context, host string) (time.Duration, error) {
+	target, err := url.Parse(host)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", target.Host)
+	if err != nil {
+		return 0, err
+	}
+	timedelta := time.Since(start)
+	conn.Close()
+	return timedelta, nil
+}
+
+func (l *LoadBalancer) ServeRPC() error {
+	config := l.Config()
+	log.Printf("Starting RPC server on %s:%d", config.Host, config.Port)
+	listener, err := net.Listen("tcp", config.Host+":"+fmt.Sprintf("%d", config.Port))
+	if err != nil {
+		return err
+	}
+	if !l.startServing(listener, nil) {
+		return nil
+	}
+	l.StartHealthChecks(context.Background())
+	return l.serveTCP(listener)
+}
+
+// serveTCP accepts connections on listener and proxies each one to a backend
+// until the listener is closed. It returns nil if that was Shutdown.
+func (l *LoadBalancer) serveTCP(listener net.Listener) error {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			if l.shuttingDown() {
+				return nil
+			}
+			return err
+		}
+		if !l.trackConn(conn) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer l.untrackConn(conn)
+			l.proxyTCP(conn)
+		}()
+	}
+}
+
+func (l *LoadBalancer) proxyTCP(client net.Conn) {
+	defer client.Close()
+	host, target := l.nextBackend(&http.Request{RemoteAddr: client.RemoteAddr().String()})
+	if target == nil {
+		log.Printf("No healthy hosts available")
+		return
+	}
+	start := time.Now()
+	defer l.release(l.acquire(host))
+	backend, err := net.DialTimeout("tcp", target.Host, tcpDialTimeout)
+	if err != nil {
+		log.Printf("Error connecting to backend %s: %s", target.Host, err)
+		l.outliers.record(host, true)
+		l.current().balancer.Done(host, time.Since(start), err)
+		return
+	}
+	l.outliers.record(host, false)
+	defer backend.Close()
+	defer func() { l.current().balancer.Done(host, time.Since(start), nil) }()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go splice(backend, client, &wg)
+	go splice(client, backend, &wg)
+	wg.Wait()
+}
+
+// splice copies src into dst and then half-closes dst, so the peer sees EOF
+// while the opposite direction keeps flowing.
+func splice(dst, src net.Conn, wg *sync.WaitGroup) {
+	defer wg.Done()
+	if _, err := io.Copy(dst, src); err != nil {
+		log.Printf("Error proxying %s -> %s: %s", src.RemoteAddr(), dst.RemoteAddr(), err)
+	}
+	if c, ok := dst.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+		return
+	}
+	dst.Close()
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// defaultShutdownTimeout is how long in-flight requests get to finish after
+// SIGTERM or SIGINT when ShutdownTimeout is not set.
+const defaultShutdownTimeout Milliseconds = 30000
+
+// servingState is what Serve started, kept so Shutdown can stop it.
+type servingState struct {
+	mu       sync.Mutex
+	closed   bool
+	listener net.Listener // the proxy's
+	server   *http.Server // nil for the rpc protocol
+	admin    *http.Server
+	conns    map[net.Conn]struct{} // open rpc client connections
+	active   sync.WaitGroup        // one per entry in conns
+}
+
+// startServing records the proxy listener and, for the http protocol, its
+// server. If Shutdown has already been called it closes listener and returns
+// false.
+func (l *LoadBalancer) startServing(listener net.Listener, server *http.Server) bool {
+	s := &l.serving
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		listener.Close()
+		return false
+	}
+	s.listener = listener
+	s.server = server
+	return true
+}
+
+// startAdmin records the admin API server, returning false if Shutdown has
+// already been called.
+func (l *LoadBalancer) startAdmin(server *http.Server) bool {
+	s := &l.serving
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.admin = server
+	return true
+}
+
+// trackConn counts an accepted rpc connection as in flight until untrackConn,
+// returning false if Shutdown has already been called.
+func (l *LoadBalancer) trackConn(conn net.Conn) bool {
+	s := &l.serving
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = map[net.Conn]struct{}{}
+	}
+	s.conns[conn] = struct{}{}
+	s.active.Add(1)
+	return true
+}
+
+func (l *LoadBalancer) untrackConn(conn net.Conn) {
+	s := &l.serving
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.active.Done()
+}
+
+func (l *LoadBalancer) shuttingDown() bool {
+	l.serving.mu.Lock()
+	defer l.serving.mu.Unlock()
+	return l.serving.closed
+}
+
+// Addr returns the address the proxy listens on, or nil until it has started.
+func (l *LoadBalancer) Addr() net.Addr {
+	l.serving.mu.Lock()
+	defer l.serving.mu.Unlock()
+	if l.serving.listener == nil {
+		return nil
+	}
+	return l.serving.listener.Addr()
+}
+
+// Shutdown stops accepting connections, waits for in-flight requests and rpc
+// connections to finish, then stops the admin API and health checks. If ctx
+// ends first the remaining connections are closed and ctx's error returned.
+// Serve returns nil as soon as Shutdown begins, so callers should wait for
+// Shutdown itself before exiting.
+func (l *LoadBalancer) Shutdown(ctx context.Context) error {
+	s := &l.serving
+	s.mu.Lock()
+	s.closed = true
+	listener, server, admin := s.listener, s.server, s.admin
+	s.mu.Unlock()
+
+	var err error
+	if server != nil {
+		if err = server.Shutdown(ctx); err != nil {
+			server.Close()
+		}
+	} else if listener != nil {
+		listener.Close()
+		err = l.drainConns(ctx)
+	}
+	if admin != nil {
+		if adminErr := admin.Shutdown(ctx); adminErr != nil {
+			admin.Close()
+			if err == nil {
+				err = adminErr
+			}
+		}
+	}
+	l.checks.stop()
+	return err
+}
+
+// drainConns waits for open rpc connections to end, closing those left when
+// ctx ends.
+func (l *LoadBalancer) drainConns(ctx context.Context) error {
+	s := &l.serving
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	return ctx.Err()
+}
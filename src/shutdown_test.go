@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	// serve runs fn and waits for the proxy to start listening.
+	serve := func(t *testing.T, lb *LoadBalancer, fn func() error) chan error {
+		t.Helper()
+		served := make(chan error, 1)
+		go func() { served <- fn() }()
+		for i := 0; i < 100 && lb.Addr() == nil; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if lb.Addr() == nil {
+			t.Fatalf("LoadBalancer did not start listening")
+		}
+		return served
+	}
+	// slowBackend answers health checks at once and holds every other request
+	// until release is closed. Once hold is set, each health check sends on
+	// held and is held until the checker gives up on it, then sends on ended.
+	slowBackend := func(t *testing.T) (*httptest.Server, chan struct{}, chan struct{}, *checkCounter) {
+		started, release := make(chan struct{}, 1), make(chan struct{})
+		checks := &checkCounter{held: make(chan struct{}), ended: make(chan struct{}, 1)}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" {
+				checks.Add(1)
+				if checks.hold.Load() {
+					select {
+					case checks.held <- struct{}{}:
+						<-r.Context().Done()
+						checks.ended <- struct{}{}
+					case <-r.Context().Done():
+					}
+				}
+				return
+			}
+			started <- struct{}{}
+			<-release
+			w.Write([]byte("done"))
+		}))
+		t.Cleanup(server.Close)
+		return server, started, release, checks
+	}
+	startHTTP := func(t *testing.T, backend string) (*LoadBalancer, chan error) {
+		t.Helper()
+		lb, err := NewLoadBalancer(&Config{
+			Host:                          "127.0.0.1",
+			InitialAddresses:              []string{backend},
+			Protocol:                      "http",
+			HealthCheckPath:               "/health",
+			HealthCheckInterval:           20,
+			HealthCheckDownInterval:       20,
+			HealthCheckTimeout:            5000,
+			HealthCheckUnhealthyThreshold: 1000,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create LoadBalancer: %v", err)
+		}
+		served := serve(t, lb, lb.ServeHTTP)
+		for i := 0; i < 100; i++ {
+			if status, _ := lb.HostStatus.Load(backend); status == HTTP_STATUS_HEALTHY {
+				return lb, served
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("backend never became healthy")
+		return nil, nil
+	}
+	get := func(url string) chan error {
+		done := make(chan error, 1)
+		go func() {
+			res, err := http.Get(url)
+			if err == nil {
+				var body []byte
+				body, err = io.ReadAll(res.Body)
+				res.Body.Close()
+				if err == nil && string(body) != "done" {
+					err = errors.New("unexpected body " + string(body))
+				}
+			}
+			done <- err
+		}()
+		return done
+	}
+
+	t.Run("TestDrainsInFlightRequests", func(t *testing.T) {
+		backend, started, release, checks := slowBackend(t)
+		lb, served := startHTTP(t, backend.URL)
+		addr := lb.Addr().String()
+		request := get("http://" + addr + "/")
+		<-started
+		// Each host is checked one at a time, so with a check held at the
+		// backend none is in transit. Shutdown cancels the held check, and
+		// any check counted after it returns was sent after Shutdown.
+		checks.hold.Store(true)
+		<-checks.held
+
+		shutdown := make(chan error, 1)
+		go func() { shutdown <- lb.Shutdown(context.Background()) }()
+		if err := <-served; err != nil {
+			t.Errorf("expected ServeHTTP to return nil, got %v", err)
+		}
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			t.Errorf("expected new connections to be refused during shutdown")
+		}
+		select {
+		case err := <-shutdown:
+			t.Fatalf("Shutdown returned with a request in flight: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(release)
+		if err := <-request; err != nil {
+			t.Errorf("in-flight request failed: %v", err)
+		}
+		if err := <-shutdown; err != nil {
+			t.Errorf("expected clean shutdown, got %v", err)
+		}
+		select {
+		case <-checks.ended:
+		case <-time.After(time.Second):
+			t.Fatalf("Shutdown did not cancel the health check in flight")
+		}
+		after := checks.Load()
+		time.Sleep(60 * time.Millisecond)
+		if got := checks.Load(); got != after {
+			t.Errorf("health checks kept running after shutdown: %d more", got-after)
+		}
+	})
+
+	t.Run("TestDeadline", func(t *testing.T) {
+		backend, started, release, _ := slowBackend(t)
+		defer close(release)
+		lb, served := startHTTP(t, backend.URL)
+		request := get("http://" + lb.Addr().String() + "/")
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := lb.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected deadline exceeded, got %v", err)
+		}
+		if err := <-request; err == nil {
+			t.Errorf("expected request still in flight at the deadline to be cut off")
+		}
+		<-served
+	})
+
+	t.Run("TestRPC", func(t *testing.T) {
+		echo := startEchoServer(t)
+		defer echo.Close()
+		address := "tcp://" + echo.Addr().String()
+		lb, err := NewLoadBalancer(&Config{Host: "127.0.0.1", InitialAddresses: []string{address}, Protocol: "rpc", HealthCheckInterval: 1000, HealthCheckTimeout: 500})
+		if err != nil {
+			t.Fatalf("Failed to create LoadBalancer: %v", err)
+		}
+		lb.HostStatus.Store(address, HTTP_STATUS_HEALTHY)
+		served := serve(t, lb, lb.ServeRPC)
+		open := func() net.Conn {
+			conn, err := net.Dial("tcp", lb.Addr().String())
+			if err != nil {
+				t.Fatalf("Failed to connect to LoadBalancer: %v", err)
+			}
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			// Make sure the proxy has accepted it before shutting down.
+			conn.Write([]byte("x"))
+			io.ReadFull(conn, make([]byte, 1))
+			return conn
+		}
+		finished, stuck := open(), open()
+		defer stuck.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		shutdown := make(chan error, 1)
+		go func() { shutdown <- lb.Shutdown(ctx) }()
+		if err := <-served; err != nil {
+			t.Errorf("expected ServeRPC to return nil, got %v", err)
+		}
+
+		// Connections opened before the shutdown keep working.
+		msg := "still here"
+		finished.Write([]byte(msg))
+		finished.(*net.TCPConn).CloseWrite()
+		if body, _ := io.ReadAll(finished); string(body) != msg {
+			t.Errorf("expected echo %q during shutdown, got %q", msg, body)
+		}
+		finished.Close()
+
+		if err := <-shutdown; !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected deadline exceeded with a connection left open, got %v", err)
+		}
+		if _, err := stuck.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("expected the remaining connection to be closed, got %v", err)
+		}
+	})
+
+	t.Run("TestBeforeServe", func(t *testing.T) {
+		lb, err := NewLoadBalancer(&Config{Host: "127.0.0.1", InitialAddresses: []string{"http://a.example"}, Protocol: "http"})
+		if err != nil {
+			t.Fatalf("Failed to create LoadBalancer: %v", err)
+		}
+		if err := lb.Shutdown(context.Background()); err != nil {
+			t.Fatalf("Shutdown failed: %v", err)
+		}
+		if err := lb.ServeHTTP(); err != nil {
+			t.Errorf("expected ServeHTTP after Shutdown to return nil, got %v", err)
+		}
+		if lb.Addr() != nil {
+			t.Errorf("expected nothing to be listening")
+		}
+	})
+}
+
+// checkCounter counts the health checks a test backend has received.
+type checkCounter struct {
+	atomic.Int64
+	hold  atomic.Bool
+	held  chan struct{}
+	ended chan struct{}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Sticky sessions pin a browser to the backend that served its first
+// response. The cookie carries an HMAC of the backend address rather than
+// the address itself, so clients can neither read nor forge the mapping.
+
+func newStickyKey(secret string) ([]byte, error) {
+	if secret != "" {
+		return []byte(secret), nil
+	}
+	// Without a configured secret, cookies only stay valid for the lifetime
+	// of this process and are not shared between load balancer instances.
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// stickyToken returns the cookie value identifying host.
+func (l *LoadBalancer) stickyToken(host string) string {
+	return newStickyToken(l.current().stickyKey, host)
+}
+
+func newStickyToken(key []byte, host string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(host))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// stickyIndexPrefix is how many characters of a token index
+// backendPool.byToken. The whole token is then checked with hmac.Equal, so
+// finding a backend costs one map lookup and one constant-time comparison
+// rather than an HMAC per backend.
+const stickyIndexPrefix = 8
+
+type stickyEntry struct {
+	token   string
+	backend *backend
+}
+
+// lookupSticky returns the backend whose token is value, or nil.
+func (p *backendPool) lookupSticky(value string) *backend {
+	if len(value) < stickyIndexPrefix {
+		return nil
+	}
+	for _, e := range p.byToken[value[:stickyIndexPrefix]] {
+		if hmac.Equal([]byte(value), []byte(e.token)) {
+			return e.backend
+		}
+	}
+	return nil
+}
+
+// stickyBackend returns the host named by the request's affinity cookie, or
+// a nil URL if there is no valid cookie or that host is down.
+func (l *LoadBalancer) stickyBackend(r *http.Request) (string, *url.URL) {
+	config := l.Config()
+	if config.StickyCookie == "" {
+		return "", nil
+	}
+	cookie, err := r.Cookie(config.StickyCookie)
+	if err != nil {
+		return "", nil
+	}
+	b := l.pool.Load().lookupSticky(cookie.Value)
+	if b == nil {
+		return "", nil
+	}
+	status, ok := l.HostStatus.Load(b.address)
+	if !ok || status == HTTP_STATUS_DOWN || status == HTTP_STATUS_EJECTED {
+		return "", nil
+	}
+	if status == HTTP_STATUS_DRAINING {
+		grace := config.DrainStickyGrace.Duration()
+		if since := time.Since(b.health.snapshot().ForcedAt); since >= grace {
+			return "", nil
+		}
+	}
+	return b.address, b.url
+}
+
+// stickyCookie builds the Set-Cookie value pinning the client to host.
+func (l *LoadBalancer) stickyCookie(host string) *http.Cookie {
+	return &http.Cookie{
+		Name:     l.Config().StickyCookie,
+		Value:    l.stickyToken(host),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// stripCookie removes the named cookie from the request so backends never see
+// the load balancer's affinity cookie. The header is edited as text rather
+// than rebuilt from r.Cookies(), which would drop cookies Go considers
+// invalid and unquote quoted values that legacy applications rely on.
+func stripCookie(r *http.Request, name string) {
+	var lines []string
+	for _, line := range r.Header.Values("Cookie") {
+		var kept []string
+		for _, segment := range strings.Split(line, ";") {
+			if cookie, _, _ := strings.Cut(segment, "="); strings.TrimSpace(cookie) != name {
+				kept = append(kept, segment)
+			}
+		}
+		if line := strings.TrimLeft(strings.Join(kept, ";"), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	r.Header.Del("Cookie")
+	for _, line := range lines {
+		r.Header.Add("Cookie", line)
+	}
+}
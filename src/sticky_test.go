@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStickySessions(t *testing.T) {
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + "|" + r.Header.Get("Cookie")))
+		}))
+	}
+	server1 := newBackend("Server 1")
+	defer server1.Close()
+	server2 := newBackend("Server 2")
+	defer server2.Close()
+
+	config := &Config{
+		InitialAddresses: []string{server1.URL, server2.URL},
+		Protocol:         "http",
+		StickyCookie:     "glb_affinity",
+		StickySecret:     "test-secret",
+	}
+	lb := newTestLoadBalancer(t, config)
+	proxy := httptest.NewServer(lb.newProxyHandler())
+	defer proxy.Close()
+
+	get := func(cookies ...*http.Cookie) (string, string, *http.Cookie) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send request to LoadBalancer: %v", err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		server, seenCookies, _ := strings.Cut(string(body), "|")
+		var affinity *http.Cookie
+		for _, c := range res.Cookies() {
+			if c.Name == config.StickyCookie {
+				affinity = c
+			}
+		}
+		return server, seenCookies, affinity
+	}
+
+	first, _, affinity := get()
+	if affinity == nil {
+		t.Fatalf("expected first response to set %s", config.StickyCookie)
+	}
+	if strings.Contains(affinity.Value, "127.0.0.1") {
+		t.Errorf("cookie leaks backend address: %s", affinity.Value)
+	}
+
+	t.Run("TestCookiePinsBackend", func(t *testing.T) {
+		other := &http.Cookie{Name: "app", Value: "1"}
+		for i := 0; i < 5; i++ {
+			server, seen, reissued := get(affinity, other)
+			if server != first {
+				t.Fatalf("request %d: expected %s, got %s", i, first, server)
+			}
+			if reissued != nil {
+				t.Errorf("request %d: cookie re-issued for pinned request", i)
+			}
+			if seen != "app=1" {
+				t.Errorf("request %d: backend saw cookies %q, expected only app=1", i, seen)
+			}
+		}
+	})
+
+	t.Run("TestOtherCookiesUntouched", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/", nil)
+		req.Header.Set("Cookie", `sess="a b"; `+config.StickyCookie+"="+affinity.Value+`; prefs={"x":"é"}; name=café`)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send request to LoadBalancer: %v", err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		server, seen, _ := strings.Cut(string(body), "|")
+		if server != first {
+			t.Errorf("expected %s, got %s", first, server)
+		}
+		if want := `sess="a b"; prefs={"x":"é"}; name=café`; seen != want {
+			t.Errorf("backend saw cookies %q, expected %q", seen, want)
+		}
+	})
+
+	t.Run("TestFallbackWhenPinnedHostDown", func(t *testing.T) {
+		pinnedHost := server1.URL
+		if first == "Server 2" {
+			pinnedHost = server2.URL
+		}
+		lb.HostStatus.Store(pinnedHost, HTTP_STATUS_DOWN)
+		defer lb.HostStatus.Store(pinnedHost, HTTP_STATUS_HEALTHY)
+
+		server, _, reissued := get(affinity)
+		if server == first {
+			t.Errorf("expected request to move away from down host %s", first)
+		}
+		if reissued == nil || reissued.Value == affinity.Value {
+			t.Errorf("expected a new affinity cookie for the fallback host, got %v", reissued)
+		}
+	})
+
+	t.Run("TestDrainingHostGrace", func(t *testing.T) {
+		pinnedHost := server1.URL
+		if first == "Server 2" {
+			pinnedHost = server2.URL
+		}
+		lb.Config().DrainStickyGrace = 100
+		defer func() { lb.Config().DrainStickyGrace = 0 }()
+		lb.ForceStatus(pinnedHost, HTTP_STATUS_DRAINING)
+		defer func() {
+			lb.ForceStatus(pinnedHost, "")
+			lb.HostStatus.Store(pinnedHost, HTTP_STATUS_HEALTHY)
+		}()
+
+		for i := 0; i < 4; i++ {
+			if server, _, _ := get(); server == first {
+				t.Fatalf("new session sent to draining host %s", first)
+			}
+		}
+		if server, _, _ := get(affinity); server != first {
+			t.Errorf("expected pinned session to stay on draining host during grace, got %s", server)
+		}
+		time.Sleep(150 * time.Millisecond)
+		if server, _, _ := get(affinity); server == first {
+			t.Errorf("expected pinned session to move once the grace period ended")
+		}
+	})
+
+	t.Run("TestForgedCookieIgnored", func(t *testing.T) {
+		_, _, reissued := get(&http.Cookie{Name: config.StickyCookie, Value: "forged"})
+		if reissued == nil {
+			t.Errorf("expected forged cookie to be replaced")
+		}
+	})
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// validate implements glb validate: it checks a config file the way serve
+// would load it and prints every problem found, exiting with 1 if there
+// were any.
+func validate(args []string) int {
+	flags := flag.NewFlagSet("glb validate", flag.ExitOnError)
+	configPath := flags.String("config", "", "path to the config file, in JSON, YAML or TOML by its extension")
+	asJSON := flags.Bool("json", false, "print the result as JSON")
+	flags.Parse(args)
+	if *configPath == "" || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: glb validate -config file [-json]")
+		return 2
+	}
+	// Problems are reported below; the readers' own log lines would repeat
+	// them.
+	log.SetOutput(io.Discard)
+	problems := validateConfigFile(*configPath)
+	if err := writeProblems(os.Stdout, *configPath, problems, *asJSON); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// configProblem is one problem found in a config file. Line and Column are
+// 0 when the problem has no place in the file, such as a required setting
+// that is missing.
+type configProblem struct {
+	Field   string `json:"field,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+// position is a place in a config file. Both parts count from 1.
+type position struct {
+	line, column int
+}
+
+// validateConfigFile returns every problem with the config file at path:
+// syntax errors, unknown fields and values of the wrong type, and then
+// everything ValidateConfig rejects once the file is laid over the defaults.
+func validateConfigFile(path string) []configProblem {
+	if _, err := NewConfigReader(path); err != nil {
+		return []configProblem{{Message: err.Error()}}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return []configProblem{{Message: err.Error()}}
+	}
+	doc, positions, problems := parseConfigDocument(path, data)
+	if len(problems) > 0 {
+		return problems
+	}
+	if problems := decodeProblems(doc, reflect.TypeFor[Config](), ""); len(problems) > 0 {
+		for i := range problems {
+			problems[i].locate(positions)
+		}
+		return sortProblems(problems)
+	}
+
+	config, _, err := (&ConfigLoader{Path: path}).Load()
+	if err != nil {
+		// Anything decodeProblems did not foresee.
+		return []configProblem{{Message: err.Error()}}
+	}
+	err = config.ValidateConfig()
+	if err == nil {
+		return nil
+	}
+	for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+		problem := configProblem{Message: err.Error()}
+		var fieldErr *FieldError
+		if errors.As(err, &fieldErr) {
+			problem.Field = fieldErr.Field
+			problem.locate(positions)
+		}
+		problems = append(problems, problem)
+	}
+	return sortProblems(problems)
+}
+
+// sortProblems orders problems as they appear in the file, followed by
+// those with no position.
+func sortProblems(problems []configProblem) []configProblem {
+	slices.SortStableFunc(problems, func(a, b configProblem) int {
+		if (a.Line == 0) != (b.Line == 0) {
+			return cmp.Compare(b.Line, a.Line)
+		}
+		return cmp.Or(cmp.Compare(a.Line, b.Line), cmp.Compare(a.Column, b.Column))
+	})
+	return problems
+}
+
+// locate sets the position of p from the closest enclosing field found in
+// the file, so a problem with Retry.MaxAttempts points at the Retry section
+// if MaxAttempts itself is not there.
+func (p *configProblem) locate(positions map[string]position) {
+	for field := strings.ToLower(p.Field); field != ""; {
+		if pos, ok := positions[field]; ok {
+			p.Line, p.Column = pos.line, pos.column
+			return
+		}
+		i := strings.LastIndexAny(field, ".[")
+		if i < 0 {
+			return
+		}
+		field = field[:i]
+	}
+}
+
+func writeProblems(w io.Writer, path string, problems []configProblem, asJSON bool) error {
+	if asJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(struct {
+			File     string          `json:"file"`
+			Valid    bool            `json:"valid"`
+			Problems []configProblem `json:"problems"`
+		}{path, len(problems) == 0, append([]configProblem{}, problems...)})
+	}
+	if len(problems) == 0 {
+		_, err := fmt.Fprintf(w, "%s: OK\n", path)
+		return err
+	}
+	for _, p := range problems {
+		where := path
+		if p.Line > 0 {
+			where += ":" + strconv.Itoa(p.Line)
+			if p.Column > 0 {
+				where += ":" + strconv.Itoa(p.Column)
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s: %s\n", where, p.Message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseConfigDocument parses data in the format of path, returning the
+// document as JSON-compatible values and the position of every field in it,
+// keyed by lower-case field path such as retry.maxattempts or
+// backends[0].address.
+func parseConfigDocument(path string, data []byte) (any, map[string]position, []configProblem) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return yamlDocument(data)
+	case ".toml":
+		return tomlDocument(data)
+	default:
+		return jsonDocument(data)
+	}
+}
+
+func joinField(path, key string) string {
+	if path == "" {
+		return strings.ToLower(key)
+	}
+	return path + "." + strings.ToLower(key)
+}
+
+func indexField(path string, i int) string {
+	return fmt.Sprintf("%s[%d]", path, i)
+}
+
+func jsonDocument(data []byte) (any, map[string]position, []configProblem) {
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		problem := configProblem{Message: strings.TrimPrefix(err.Error(), "json: ")}
+		var syntax *json.SyntaxError
+		if errors.As(err, &syntax) {
+			pos := offsetPosition(data, max(syntax.Offset-1, 0))
+			problem.Line, problem.Column = pos.line, pos.column
+		}
+		return nil, nil, []configProblem{problem}
+	}
+
+	// The document is known to be valid, so the walk cannot fail.
+	positions := map[string]position{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	next := func() position {
+		offset := decoder.InputOffset()
+		for offset < int64(len(data)) && strings.IndexByte(" \t\r\n,:", data[offset]) >= 0 {
+			offset++
+		}
+		return offsetPosition(data, offset)
+	}
+	var walk func(path string)
+	walk = func(path string) {
+		token, _ := decoder.Token()
+		switch token {
+		case json.Delim('{'):
+			for decoder.More() {
+				pos := next()
+				key, _ := decoder.Token()
+				field := joinField(path, key.(string))
+				positions[field] = pos
+				walk(field)
+			}
+			decoder.Token()
+		case json.Delim('['):
+			for i := 0; decoder.More(); i++ {
+				field := indexField(path, i)
+				positions[field] = next()
+				walk(field)
+			}
+			decoder.Token()
+		}
+	}
+	walk("")
+	return doc, positions, nil
+}
+
+// offsetPosition converts a byte offset in data to a line and column.
+func offsetPosition(data []byte, offset int64) position {
+	before := data[:min(offset, int64(len(data)))]
+	line := bytes.Count(before, []byte("\n")) + 1
+	return position{line, len(before) - bytes.LastIndexByte(before, '\n')}
+}
+
+// yamlErrorLine matches the line number yaml.v3 puts in its messages.
+var yamlErrorLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+func yamlDocument(data []byte) (any, map[string]position, []configProblem) {
+	var root yaml.Node
+	err := yaml.Unmarshal(data, &root)
+	var doc any
+	if err == nil {
+		err = root.Decode(&doc)
+	}
+	if err != nil {
+		messages := []string{err.Error()}
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			messages = typeErr.Errors
+		}
+		var problems []configProblem
+		for _, message := range messages {
+			problem := configProblem{Message: message}
+			if m := yamlErrorLine.FindStringSubmatch(message); m != nil {
+				problem.Line, _ = strconv.Atoi(m[1])
+				problem.Message = m[2]
+			}
+			problems = append(problems, problem)
+		}
+		return nil, nil, problems
+	}
+
+	positions := map[string]position{}
+	var walk func(node *yaml.Node, path string)
+	walk = func(node *yaml.Node, path string) {
+		switch node.Kind {
+		case yaml.DocumentNode:
+			for _, child := range node.Content {
+				walk(child, path)
+			}
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key := node.Content[i]
+				field := joinField(path, key.Value)
+				positions[field] = position{key.Line, key.Column}
+				walk(node.Content[i+1], field)
+			}
+		case yaml.SequenceNode:
+			for i, item := range node.Content {
+				field := indexField(path, i)
+				positions[field] = position{item.Line, item.Column}
+				walk(item, field)
+			}
+		}
+	}
+	walk(&root, "")
+	return jsonCompatible(doc), positions, nil
+}
+
+// tomlKey matches a key = value line, with a bare, quoted or dotted key.
+var tomlKey = regexp.MustCompile(`^\s*((?:[A-Za-z0-9_-]+|"[^"]*")(?:\s*\.\s*(?:[A-Za-z0-9_-]+|"[^"]*"))*)\s*=`)
+
+func tomlDocument(data []byte) (any, map[string]position, []configProblem) {
+	doc := map[string]any{}
+	if _, err := toml.Decode(string(data), &doc); err != nil {
+		problem := configProblem{Message: strings.TrimPrefix(err.Error(), "toml: ")}
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			problem.Line, problem.Column, problem.Message = parseErr.Position.Line, parseErr.Position.Col, parseErr.Message
+		}
+		return nil, nil, []configProblem{problem}
+	}
+
+	// The toml package does not expose where keys are, so find them from
+	// the table headers and key = value lines. Values spanning several
+	// lines are placed at their key.
+	positions := map[string]position{}
+	tables := map[string]int{} // array of tables -> entries so far
+	table := ""
+	for i, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+		pos := position{i + 1, len(line) - len(strings.TrimLeft(line, " \t")) + 1}
+		switch {
+		case strings.HasPrefix(trimmed, "[["):
+			name := tomlPath(strings.TrimPrefix(strings.SplitN(trimmed, "]]", 2)[0], "[["))
+			if _, ok := positions[name]; !ok {
+				positions[name] = pos
+			}
+			table = indexField(name, tables[name])
+			tables[name]++
+			positions[table] = pos
+		case strings.HasPrefix(trimmed, "["):
+			table = tomlPath(strings.TrimPrefix(strings.SplitN(trimmed, "]", 2)[0], "["))
+			positions[table] = pos
+		default:
+			if m := tomlKey.FindStringSubmatch(line); m != nil {
+				field := table
+				for _, key := range strings.Split(tomlPath(m[1]), ".") {
+					field = joinField(field, key)
+					if _, ok := positions[field]; !ok {
+						positions[field] = pos
+					}
+				}
+			}
+		}
+	}
+	return doc, positions, nil
+}
+
+// tomlPath turns a TOML key such as Retry . "MaxAttempts" into retry.maxattempts.
+func tomlPath(key string) string {
+	var parts []string
+	for _, part := range strings.Split(key, ".") {
+		parts = append(parts, strings.ToLower(strings.Trim(strings.TrimSpace(part), `"`)))
+	}
+	return strings.Join(parts, ".")
+}
+
+// decodeProblems decodes doc into type t one field at a time, so that every
+// unknown field and value of the wrong type is reported with its path
+// rather than only the first.
+func decodeProblems(doc any, t reflect.Type, path string) []configProblem {
+	fieldName := func(key string) string {
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+	switch {
+	case t.Kind() == reflect.Struct && !reflect.PointerTo(t).Implements(textUnmarshaler):
+		m, ok := doc.(map[string]any)
+		if !ok {
+			break
+		}
+		var problems []configProblem
+		for _, key := range slices.Sorted(maps.Keys(m)) {
+			// Field names match case-insensitively, as in encoding/json.
+			field, ok := t.FieldByNameFunc(func(name string) bool { return strings.EqualFold(name, key) })
+			if !ok {
+				problems = append(problems, configProblem{Field: fieldName(key), Message: "Unknown config field " + fieldName(key)})
+				continue
+			}
+			problems = append(problems, decodeProblems(m[key], field.Type, fieldName(field.Name))...)
+		}
+		return problems
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Struct:
+		items, ok := doc.([]any)
+		if !ok {
+			break
+		}
+		var problems []configProblem
+		for i, item := range items {
+			problems = append(problems, decodeProblems(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+		return problems
+	}
+
+	data, err := json.Marshal(doc)
+	if err == nil {
+		err = json.Unmarshal(data, reflect.New(t).Interface())
+	}
+	if err == nil {
+		return nil
+	}
+	message := strings.TrimPrefix(err.Error(), "json: ")
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		message = fmt.Sprintf("expected %s, got %s", typeErr.Type, typeErr.Value)
+	}
+	return []configProblem{{Field: path, Message: path + ": " + message}}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	log.SetOutput(io.Discard)
+	write := func(t *testing.T, name, content string) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+		return path
+	}
+	// positions lists line:column of each problem with the start of its
+	// message.
+	positions := func(problems []configProblem) []string {
+		var got []string
+		for _, p := range problems {
+			word, _, _ := strings.Cut(p.Message, " ")
+			got = append(got, fmt.Sprintf("%d:%d:%s", p.Line, p.Column, word))
+		}
+		return got
+	}
+
+	t.Run("TestValidConfig", func(t *testing.T) {
+		path := write(t, "config.yaml", "InitialAddresses: [http://a.example]\nHealthCheckInterval: 5s\n")
+		if problems := validateConfigFile(path); len(problems) != 0 {
+			t.Errorf("expected no problems, got %+v", problems)
+		}
+	})
+
+	t.Run("TestAllProblemsWithPositions", func(t *testing.T) {
+		files := map[string]struct {
+			content string
+			want    []string
+		}{
+			"config.json": {
+				"{\n  \"Port\": 70000,\n  \"InitialAddresses\": [\"http://a.example\", \"a.example:80\"],\n  \"Retry\": {\"MaxAttempts\": -1}\n}",
+				[]string{"2:3:Port", "3:44:Backend", "4:13:Retry.MaxAttempts"},
+			},
+			"config.yaml": {
+				"Port: 70000\nBackends:\n  - Address: http://a.example\n  - Address: ftp://b.example\nHealthCheckTimeout: 20s\n",
+				[]string{"1:1:Port", "4:5:Backend", "5:1:HealthCheckTimeout"},
+			},
+			"config.toml": {
+				"Port = 70000\nInitialAddresses = [\"http://a.example\"]\n\n[[Backends]]\nAddress = \"http://b.example\"\n\n[[Backends]]\n  Address = \"c.example\"\n",
+				[]string{"1:1:Port", "8:3:Backend"},
+			},
+		}
+		for name, file := range files {
+			got := positions(validateConfigFile(write(t, name, file.content)))
+			if !reflect.DeepEqual(got, file.want) {
+				t.Errorf("%s: expected %q, got %q", name, file.want, got)
+			}
+		}
+	})
+
+	t.Run("TestDecodeProblems", func(t *testing.T) {
+		path := write(t, "config.yaml", "Port: eighty\nRetry:\n  MaxAttemps: 2\nBackends:\n  - Address: http://a.example\n    Weight: heavy\nHealthCheckInterval: soon\n")
+		problems := validateConfigFile(path)
+		if got, want := positions(problems), []string{"1:1:Port:", "3:3:Unknown", "6:5:Backends[0].Weight:", "7:1:HealthCheckInterval:"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %q, got %q", want, got)
+		}
+		if !strings.Contains(problems[1].Message, "Retry.MaxAttemps") {
+			t.Errorf("expected the full path of the unknown field, got %q", problems[1].Message)
+		}
+	})
+
+	t.Run("TestSyntaxErrors", func(t *testing.T) {
+		files := map[string]string{
+			"config.json": "{\"Port\": 1,\n  \"Host\": x}",
+			"config.yaml": "Port: 1\n  Host: [\n",
+			"config.toml": "Port = 8080\nInitialAddresses = [\"http://a.example\"\n",
+		}
+		for name, content := range files {
+			problems := validateConfigFile(write(t, name, content))
+			if len(problems) != 1 || problems[0].Line != 2 {
+				t.Errorf("%s: expected one problem on line 2, got %+v", name, problems)
+			}
+		}
+		for _, path := range []string{"config.ini", filepath.Join(t.TempDir(), "missing.json")} {
+			if problems := validateConfigFile(path); len(problems) != 1 || problems[0].Line != 0 {
+				t.Errorf("%s: expected one problem without a position, got %+v", path, problems)
+			}
+		}
+	})
+
+	t.Run("TestJSONOutput", func(t *testing.T) {
+		path := write(t, "config.json", `{"InitialAddresses": ["http://a.example"], "Port": -1}`)
+		var out bytes.Buffer
+		if err := writeProblems(&out, path, validateConfigFile(path), true); err != nil {
+			t.Fatalf("writeProblems() error = %v", err)
+		}
+		var result struct {
+			File     string
+			Valid    bool
+			Problems []configProblem
+		}
+		if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+			t.Fatalf("output is not JSON: %v\n%s", err, out.String())
+		}
+		want := []configProblem{{Field: "Port", Line: 1, Column: 44, Message: "Port -1 must be between 0 and 65535"}}
+		if result.File != path || result.Valid || !reflect.DeepEqual(result.Problems, want) {
+			t.Errorf("unexpected result %+v", result)
+		}
+
+		out.Reset()
+		writeProblems(&out, path, nil, true)
+		if !strings.Contains(out.String(), `"valid": true`) || !strings.Contains(out.String(), `"problems": []`) {
+			t.Errorf("unexpected output for a valid config:\n%s", out.String())
+		}
+	})
+}